@@ -0,0 +1,87 @@
+package dnscache
+
+import "sync/atomic"
+
+// Cache is the storage backend holding the cache entries of a Resolver.
+// Implementations must be safe for concurrent use and bound their size on
+// their own, reporting in Add whether an entry was evicted to make room for
+// the new one. Keys and values are opaque to the Cache.
+//
+// The default backend is a github.com/hashicorp/golang-lru Cache.
+type Cache interface {
+	// Get returns the value stored for key.
+	Get(key interface{}) (value interface{}, ok bool)
+	// Add stores value for key, reporting whether an eviction occurred.
+	Add(key, value interface{}) (evicted bool)
+	// Remove removes key, reporting whether it was present.
+	Remove(key interface{}) (present bool)
+	// Keys returns the stored keys, from oldest to newest.
+	Keys() []interface{}
+	// Purge removes all entries.
+	Purge()
+	// Len returns the number of stored entries.
+	Len() int
+}
+
+// nopCache is a Cache storing nothing. It replaces missing cache backends so
+// that a misconfigured Resolver performs every lookup upstream instead of
+// panicking.
+type nopCache struct{}
+
+func (nopCache) Get(interface{}) (interface{}, bool) { return nil, false }
+func (nopCache) Add(_, _ interface{}) bool           { return false }
+func (nopCache) Remove(interface{}) bool             { return false }
+func (nopCache) Keys() []interface{}                 { return nil }
+func (nopCache) Purge()                              {}
+func (nopCache) Len() int                            { return 0 }
+
+// size returns the maximum number of entries of the cache, as set with
+// WithCacheSize or Resize, or 0 if unknown.
+func (r *Resolver) size() int {
+	r.sizeMu.Lock()
+	defer r.sizeMu.Unlock()
+	return r.cacheSize
+}
+
+// resizer is implemented by Cache backends supporting resizing, such as the
+// default LRU cache.
+type resizer interface {
+	Resize(size int) (evicted int)
+}
+
+// Resize changes the maximum number of entries held in the cache, returning
+// the number of entries evicted when shrinking. The size is split evenly
+// across shards, each holding at least one entry. With WithAddrCacheSize,
+// only the cache of forward lookups is resized. It is a no-op returning 0 if
+// size is not positive or the Cache backend does not support resizing.
+func (r *Resolver) Resize(size int) (evicted int) {
+	if size <= 0 {
+		return 0
+	}
+	shards := r.forwardShards()
+	for _, s := range shards {
+		if _, ok := s.cache.(resizer); !ok {
+			return 0
+		}
+	}
+	r.sizeMu.Lock()
+	if size < len(shards) {
+		size = len(shards)
+	}
+	var keys []cacheKey
+	for i, shardSize := range splitSize(size, len(shards)) {
+		s := shards[i]
+		s.mu.Lock()
+		evicted += s.resize(shardSize)
+		keys = append(keys, s.takeEvicted()...)
+		s.mu.Unlock()
+	}
+	r.cacheSize = size
+	r.sizeMu.Unlock()
+	atomic.AddUint64(&r.stats.Evictions, uint64(evicted))
+	if evicted > 0 {
+		r.reportSize()
+	}
+	r.notifyEvicted(keys)
+	return evicted
+}
@@ -0,0 +1,324 @@
+package dnscache
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// mapCache is an unbounded Cache backed by a map, recording the number of
+// calls to each method.
+type mapCache struct {
+	mu    sync.Mutex
+	m     map[interface{}]interface{}
+	keys  []interface{}
+	calls map[string]int
+}
+
+func newMapCache() *mapCache {
+	return &mapCache{m: map[interface{}]interface{}{}, calls: map[string]int{}}
+}
+
+func (c *mapCache) Get(key interface{}) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls["Get"]++
+	v, ok := c.m[key]
+	return v, ok
+}
+
+func (c *mapCache) Add(key, value interface{}) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls["Add"]++
+	if _, ok := c.m[key]; !ok {
+		c.keys = append(c.keys, key)
+	}
+	c.m[key] = value
+	return false
+}
+
+func (c *mapCache) Remove(key interface{}) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls["Remove"]++
+	if _, ok := c.m[key]; !ok {
+		return false
+	}
+	delete(c.m, key)
+	for i, k := range c.keys {
+		if k == key {
+			c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+func (c *mapCache) Keys() []interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls["Keys"]++
+	return append([]interface{}(nil), c.keys...)
+}
+
+func (c *mapCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls["Purge"]++
+	c.m = map[interface{}]interface{}{}
+	c.keys = nil
+}
+
+func (c *mapCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls["Len"]++
+	return len(c.m)
+}
+
+func TestResolver_CustomCache(t *testing.T) {
+	c := newMapCache()
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"1.2.3.4"}}}
+	r, err := New(WithCache(c), WithResolver(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	r.LookupHost(ctx, "example.com")
+	r.LookupHost(ctx, "example.com")
+	if f.callCount() != 1 {
+		t.Errorf("got %d upstream calls, want 1", f.callCount())
+	}
+	if r.Len() != 1 || len(r.Keys()) != 1 {
+		t.Errorf("got len %d and keys %v, want one entry", r.Len(), r.Keys())
+	}
+	r.Refresh()
+	r.Remove("example.com")
+	r.Clear()
+	for _, method := range []string{"Get", "Add", "Remove", "Keys", "Purge", "Len"} {
+		if c.calls[method] == 0 {
+			t.Errorf("%s was never called", method)
+		}
+	}
+}
+
+func TestResolver_Resize(t *testing.T) {
+	f := &fakeResolver{}
+	r := NewDNSResolver(5)
+	r.Resolver = f
+	for i := 0; i < 5; i++ {
+		r.LookupHost(context.Background(), fmt.Sprintf("host%d.com", i))
+	}
+	if evicted := r.Resize(2); evicted != 3 {
+		t.Errorf("got %d evicted, want 3", evicted)
+	}
+	want := []Key{{KindHost, "host3.com"}, {KindHost, "host4.com"}}
+	if got := r.Keys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got keys %v, want %v", got, want)
+	}
+	if got := r.Stats().Evictions; got != 3 {
+		t.Errorf("got %d evictions in stats, want 3", got)
+	}
+	for _, size := range []int{0, -1} {
+		if evicted := r.Resize(size); evicted != 0 || r.Len() != 2 {
+			t.Errorf("Resize(%d) = %d with %d entries left, want a no-op", size, evicted, r.Len())
+		}
+	}
+	if evicted := r.Resize(10); evicted != 0 {
+		t.Errorf("got %d evicted when growing, want 0", evicted)
+	}
+}
+
+func TestResolver_AddrCacheSize(t *testing.T) {
+	f := &fakeResolver{}
+	r, err := New(WithCacheSize(10), WithAddrCacheSize(20), WithShards(1), WithResolver(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		r.LookupHost(ctx, fmt.Sprintf("host%d", i))
+	}
+	for i := 0; i < 50; i++ {
+		r.LookupAddr(ctx, fmt.Sprintf("192.0.2.%d", i))
+	}
+	if got := r.Len(); got != 30 {
+		t.Errorf("got %d entries, want 30", got)
+	}
+	calls := f.callCount()
+	for i := 0; i < 10; i++ {
+		r.LookupHost(ctx, fmt.Sprintf("host%d", i))
+	}
+	if got := f.callCount() - calls; got != 0 {
+		t.Errorf("reverse lookups evicted %d host entries", got)
+	}
+
+	for i := 10; i < 50; i++ {
+		r.LookupHost(ctx, fmt.Sprintf("host%d", i))
+	}
+	calls = f.callCount()
+	for i := 30; i < 50; i++ {
+		r.LookupAddr(ctx, fmt.Sprintf("192.0.2.%d", i))
+	}
+	if got := f.callCount() - calls; got != 0 {
+		t.Errorf("host lookups evicted %d address entries", got)
+	}
+
+	if got := len(r.Keys()); got != 30 {
+		t.Errorf("got %d keys, want 30", got)
+	}
+	calls = f.callCount()
+	r.Refresh()
+	if got := f.callCount() - calls; got != 30 {
+		t.Errorf("got %d refreshed entries, want 30", got)
+	}
+	r.Clear()
+	if got := r.Len(); got != 0 {
+		t.Errorf("got %d entries after Clear, want 0", got)
+	}
+}
+
+func TestResolver_NilCache(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"192.0.2.1"}}}
+	r := &Resolver{Resolver: f, shards: []*shard{{}}}
+
+	for i := 0; i < 2; i++ {
+		addrs, err := r.LookupHost(context.Background(), "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"192.0.2.1"}; !reflect.DeepEqual(addrs, want) {
+			t.Errorf("got %v, want %v", addrs, want)
+		}
+	}
+	if got := f.callCount(); got != 2 {
+		t.Errorf("got %d upstream calls, want 2", got)
+	}
+	if got := r.Keys(); len(got) != 0 {
+		t.Errorf("got keys %v, want none", got)
+	}
+	if got := r.Len(); got != 0 {
+		t.Errorf("got %d entries, want 0", got)
+	}
+	r.Refresh()
+	if got := f.callCount(); got != 2 {
+		t.Errorf("got %d upstream calls after Refresh, want 2", got)
+	}
+	r.Clear()
+	if r.Remove("example.com") {
+		t.Error("Remove reported a removed entry")
+	}
+}
+
+func TestResolver_SharedCache(t *testing.T) {
+	cache, err := lru.New(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"192.0.2.1"}}}
+	r1, err := New(WithCache(cache), WithResolver(f), WithTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := New(WithCache(cache), WithResolver(f), WithTimeout(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r1.LookupHost(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	_, hit, err := r2.LookupHostCached(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hit {
+		t.Error("entry stored by one resolver missed by the other")
+	}
+	r2.Remove("example.com")
+	if r1.Len() != 0 {
+		t.Error("entry removed by one resolver still cached by the other")
+	}
+
+	// Refreshes and lookups through both resolvers do not race.
+	r1.TTL = time.Nanosecond
+	r2.TTL = time.Nanosecond
+	var wg sync.WaitGroup
+	for _, r := range []*Resolver{r1, r2} {
+		wg.Add(1)
+		go func(r *Resolver) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				r.LookupHost(context.Background(), "example.com")
+				r.Refresh()
+			}
+		}(r)
+	}
+	wg.Wait()
+}
+
+func TestResolver_MaxBytes(t *testing.T) {
+	small := []string{"192.0.2.1"}
+	var large []string
+	for i := 0; i < 50; i++ {
+		large = append(large, fmt.Sprintf("2001:db8::%d", i))
+	}
+	held := func(addrs []string) int {
+		hosts := map[string][]string{}
+		for i := 0; i < 100; i++ {
+			hosts[fmt.Sprintf("host%d.com", i)] = addrs
+		}
+		f := &fakeResolver{hosts: hosts}
+		r, err := New(WithMaxBytes(8192), WithShards(1), WithResolver(f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for host := range hosts {
+			r.LookupHost(context.Background(), host)
+		}
+		if got := r.Stats().Evictions; got != uint64(100-r.Len()) {
+			t.Errorf("got %d evictions in stats, want %d", got, 100-r.Len())
+		}
+		return r.Len()
+	}
+	nsmall, nlarge := held(small), held(large)
+	if nsmall <= nlarge {
+		t.Errorf("got %d small and %d large entries, want fewer large ones", nsmall, nlarge)
+	}
+	if nlarge == 0 || nlarge > 10 {
+		t.Errorf("got %d large entries, want between 1 and 10", nlarge)
+	}
+
+	if _, err := New(WithMaxBytes(0)); err == nil {
+		t.Error("got no error for a zero byte cap")
+	}
+}
+
+func TestResolver_MaxBytesWithCache(t *testing.T) {
+	cache, err := lru.New(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(WithCache(cache), WithMaxBytes(2000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		r.Set(fmt.Sprintf("host%d.com", i), []string{"192.0.2.1"})
+	}
+	if got := r.Len(); got != 50 {
+		t.Errorf("got %d entries, want 50 as the byte cap does not apply to WithCache", got)
+	}
+	r.Clear()
+	r.Set("a.com", []string{"192.0.2.1"})
+	r.Set("b.com", []string{"192.0.2.1"})
+	if got := r.Len(); got != 2 {
+		t.Errorf("got %d entries after Clear, want 2", got)
+	}
+}
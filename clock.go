@@ -0,0 +1,14 @@
+package dnscache
+
+import "time"
+
+// Clock tells the current time. It is used for all entry expiries and
+// timestamps, so tests can control time instead of sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the Clock used by default, returning time.Now.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
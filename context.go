@@ -0,0 +1,37 @@
+package dnscache
+
+import "context"
+
+type contextKey int
+
+const (
+	forceRefreshKey contextKey = iota
+	resolverKey
+)
+
+// WithForceRefresh returns a copy of ctx making lookups bypass the cache. The
+// fresh result is stored in the cache as usual and concurrent forced lookups
+// of the same subject are still merged.
+func WithForceRefresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceRefreshKey, true)
+}
+
+// forceRefresh reports whether ctx was created with WithForceRefresh.
+func forceRefresh(ctx context.Context) bool {
+	force, _ := ctx.Value(forceRefreshKey).(bool)
+	return force
+}
+
+// ContextWithResolver returns a copy of ctx making lookups use resolver
+// instead of the Resolver field, e.g. to query the private DNS of a tenant.
+// Such lookups bypass the cache entirely: they are neither served from nor
+// stored in the cache shared by other lookups.
+func ContextWithResolver(ctx context.Context, resolver DNSResolver) context.Context {
+	return context.WithValue(ctx, resolverKey, resolver)
+}
+
+// contextResolver returns the resolver set on ctx by ContextWithResolver.
+func contextResolver(ctx context.Context) (DNSResolver, bool) {
+	resolver, ok := ctx.Value(resolverKey).(DNSResolver)
+	return resolver, ok && resolver != nil
+}
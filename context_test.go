@@ -0,0 +1,58 @@
+package dnscache
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWithForceRefresh(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"1.2.3.4"}}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.LookupHost(context.Background(), "example.com")
+	f.hosts = map[string][]string{"example.com": {"5.6.7.8"}}
+
+	addrs, err := r.LookupHost(WithForceRefresh(context.Background()), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "5.6.7.8" {
+		t.Errorf("got %v, want fresh [5.6.7.8]", addrs)
+	}
+	addrs, _ = r.LookupHost(context.Background(), "example.com")
+	if len(addrs) != 1 || addrs[0] != "5.6.7.8" {
+		t.Errorf("got %v from cache, want updated [5.6.7.8]", addrs)
+	}
+	if f.callCount() != 2 {
+		t.Errorf("got %d upstream calls, want 2", f.callCount())
+	}
+}
+
+func TestContextWithResolver(t *testing.T) {
+	shared := &fakeResolver{hosts: map[string][]string{"db.internal": {"10.0.0.1"}}}
+	tenant := &fakeResolver{hosts: map[string][]string{"db.internal": {"192.168.0.1"}}}
+	r := NewDNSResolver(128)
+	r.Resolver = shared
+	r.LookupHost(context.Background(), "db.internal")
+
+	ctx := ContextWithResolver(context.Background(), tenant)
+	for i := 0; i < 2; i++ {
+		addrs, err := r.LookupHost(ctx, "db.internal")
+		if err != nil || len(addrs) != 1 || addrs[0] != "192.168.0.1" {
+			t.Errorf("got (%v, %v), want the tenant address [192.168.0.1]", addrs, err)
+		}
+	}
+	if tenant.callCount() != 2 {
+		t.Errorf("got %d tenant upstream calls, want 2 as the cache is bypassed", tenant.callCount())
+	}
+	addrs, _ := r.LookupHost(context.Background(), "db.internal")
+	if len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+		t.Errorf("got %v from the shared cache, want [10.0.0.1]", addrs)
+	}
+	if shared.callCount() != 1 {
+		t.Errorf("got %d shared upstream calls, want 1", shared.callCount())
+	}
+	if _, err := r.LookupCNAME(ctx, "db.internal"); err != nil {
+		t.Errorf("LookupCNAME: got %v, want the tenant resolver capabilities", err)
+	}
+}
@@ -0,0 +1,196 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// defaultFallbackDelay is the FallbackDelay of DialOptions if not set, the
+// same as the default of net.Dialer.
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// DialOptions configures the dial function returned by DialContextOptions.
+type DialOptions struct {
+	// Dialer dials each address. If nil, a zero net.Dialer is used.
+	Dialer *net.Dialer
+
+	// Dial, if set, is used to dial each address instead of Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// FallbackDelay is the time to wait for the addresses of the preferred
+	// family to connect before also dialing the addresses of the other
+	// family, as in RFC 8305 "Happy Eyeballs". The first connection made
+	// wins and the other attempt is cancelled. If zero, 300ms is used. If
+	// negative, addresses are dialed one at a time in the order returned
+	// by LookupIP.
+	FallbackDelay time.Duration
+
+	// PreferIPv4 makes IPv4 addresses dialed first. By default, IPv6
+	// addresses are.
+	PreferIPv4 bool
+}
+
+// DialContext returns a dial function suitable for http.Transport.DialContext
+// resolving hosts through the cache. Each resolved address is dialed in order
+// using base until one connects; the error of the last attempt is returned if
+// all fail. If base is nil, a zero net.Dialer is used.
+func (r *Resolver) DialContext(base *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return r.DialContextOptions(DialOptions{Dialer: base, FallbackDelay: -1})
+}
+
+// DialContextOptions is like DialContext, dialing IPv6 and IPv4 addresses in
+// parallel as configured by opts. The addresses of each family are dialed in
+// order until one connects; the error of the preferred family is returned if
+// all fail.
+func (r *Resolver) DialContextOptions(opts DialOptions) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := opts.Dial
+	if dial == nil {
+		base := opts.Dialer
+		if base == nil {
+			base = &net.Dialer{}
+		}
+		dial = base.DialContext
+	}
+	delay := opts.FallbackDelay
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		ips, err := r.LookupIP(ctx, ipNetwork(network), host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		if delay < 0 {
+			return dialSerial(ctx, dial, network, port, ips)
+		}
+		primaries, fallbacks := splitFamily(ips, opts.PreferIPv4)
+		if len(primaries) == 0 || len(fallbacks) == 0 {
+			return dialSerial(ctx, dial, network, port, ips)
+		}
+		return dialParallel(ctx, dial, network, port, primaries, fallbacks, delay)
+	}
+}
+
+// dialSerial dials ips in order until one connects, returning the error of
+// the last attempt if all fail.
+func dialSerial(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), network, port string, ips []net.IP) (net.Conn, error) {
+	var err error
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dial(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// dialParallel races dialSerial of primaries against dialSerial of
+// fallbacks, started after delay or as soon as primaries all fail. It
+// returns the first connection made, cancelling the other attempt and
+// closing any connection it makes afterwards.
+func dialParallel(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), network, port string, primaries, fallbacks []net.IP, delay time.Duration) (net.Conn, error) {
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+		done    bool
+	}
+	results := make(chan dialResult)
+	returned := make(chan struct{})
+	defer close(returned)
+	race := func(ctx context.Context, ips []net.IP, primary bool) {
+		conn, err := dialSerial(ctx, dial, network, port, ips)
+		select {
+		case results <- dialResult{conn: conn, err: err, primary: primary, done: true}:
+		case <-returned:
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	primaryCtx, primaryCancel := context.WithCancel(ctx)
+	defer primaryCancel()
+	go race(primaryCtx, primaries, true)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var primary, fallback dialResult
+	for {
+		select {
+		case <-timer.C:
+			fallbackCtx, fallbackCancel := context.WithCancel(ctx)
+			defer fallbackCancel()
+			go race(fallbackCtx, fallbacks, false)
+		case res := <-results:
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if res.primary {
+				primary = res
+			} else {
+				fallback = res
+			}
+			if primary.done && fallback.done {
+				return nil, primary.err
+			}
+			if res.primary && timer.Stop() {
+				// Start the fallbacks right away.
+				timer.Reset(0)
+			}
+		}
+	}
+}
+
+// splitFamily splits ips in the addresses of the preferred family, IPv6
+// unless preferIPv4 is set, and the others, keeping their order.
+func splitFamily(ips []net.IP, preferIPv4 bool) (primaries, fallbacks []net.IP) {
+	for _, ip := range ips {
+		if (ip.To4() != nil) == preferIPv4 {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	return primaries, fallbacks
+}
+
+// NewSystemResolver returns a DNSResolver using the pure Go resolver of the
+// net package, sending DNS queries through dial. It allows caching lookups
+// against a DNS server other than the system default, e.g.:
+//
+//	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+//		var d net.Dialer
+//		return d.DialContext(ctx, network, "10.0.0.53:53")
+//	}
+//	r, err := dnscache.New(dnscache.WithResolver(dnscache.NewSystemResolver(dial)))
+func NewSystemResolver(dial func(ctx context.Context, network, address string) (net.Conn, error)) DNSResolver {
+	return &net.Resolver{PreferGo: true, Dial: dial}
+}
+
+// ipNetwork returns the LookupIP network matching the address family of the
+// dial network.
+func ipNetwork(network string) string {
+	switch network {
+	case "tcp4", "udp4", "ip4":
+		return "ip4"
+	case "tcp6", "udp6", "ip6":
+		return "ip6"
+	}
+	return "ip"
+}
@@ -0,0 +1,170 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResolver_DialContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// Nothing listens on 127.0.0.2, so the first address refuses the
+	// connection.
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"127.0.0.2", "127.0.0.1"}}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+
+	dial := r.DialContext(nil)
+	conn, err := dial(context.Background(), "tcp", net.JoinHostPort("example.com", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != ln.Addr().String() {
+		t.Errorf("connected to %s, want %s", got, ln.Addr())
+	}
+}
+
+func TestResolver_DialContextAllFail(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"127.0.0.2", "127.0.0.1"}}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+
+	dial := r.DialContext(nil)
+	if _, err := dial(context.Background(), "tcp", net.JoinHostPort("example.com", port)); err == nil {
+		t.Error("got nil error, want connection refused")
+	}
+}
+
+func TestNewSystemResolver(t *testing.T) {
+	var mu sync.Mutex
+	var dialed []string
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, address)
+		mu.Unlock()
+		return nil, errors.New("dial refused")
+	}
+	r, err := New(WithResolver(NewSystemResolver(dial)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.LookupHost(context.Background(), "dnscache.invalid"); err == nil {
+		t.Fatal("lookup succeeded, want an error")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) == 0 {
+		t.Fatal("dial was not called")
+	}
+	for _, address := range dialed {
+		if _, port, err := net.SplitHostPort(address); err != nil || port != "53" {
+			t.Errorf("dialed %q, want a DNS server address", address)
+		}
+	}
+}
+
+func TestResolver_DialContextOptions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// The IPv6 address never connects, until its attempt is cancelled.
+	cancelled := make(chan error, 1)
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(addr)
+		if net.ParseIP(host).To4() == nil {
+			<-ctx.Done()
+			cancelled <- ctx.Err()
+			return nil, ctx.Err()
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"2001:db8::1", "127.0.0.1"}}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+
+	d := r.DialContextOptions(DialOptions{Dial: dial, FallbackDelay: 10 * time.Millisecond})
+	conn, err := d(context.Background(), "tcp", net.JoinHostPort("example.com", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != ln.Addr().String() {
+		t.Errorf("connected to %s, want %s", got, ln.Addr())
+	}
+	select {
+	case err := <-cancelled:
+		if err != context.Canceled {
+			t.Errorf("IPv6 attempt ended with %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("IPv6 attempt was not cancelled")
+	}
+}
+
+func TestResolver_DialContextOptionsFallbackOnFailure(t *testing.T) {
+	// The IPv6 address fails at once, so IPv4 is dialed without waiting
+	// for FallbackDelay.
+	var mu sync.Mutex
+	var dialed []string
+	errRefused := errors.New("connection refused")
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+		return nil, errRefused
+	}
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"127.0.0.1", "2001:db8::1"}}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+
+	d := r.DialContextOptions(DialOptions{Dial: dial, FallbackDelay: time.Hour})
+	if _, err := d(context.Background(), "tcp", "example.com:80"); err != errRefused {
+		t.Errorf("got %v, want %v", err, errRefused)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"[2001:db8::1]:80", "127.0.0.1:80"}; !reflect.DeepEqual(dialed, want) {
+		t.Errorf("dialed %v, want %v", dialed, want)
+	}
+}
@@ -2,12 +2,18 @@ package dnscache
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru"
-
 	"golang.org/x/sync/singleflight"
 )
 
@@ -16,135 +22,1125 @@ type DNSResolver interface {
 	LookupAddr(ctx context.Context, addr string) (names []string, err error)
 }
 
+// CNAMEResolver is implemented by DNSResolvers supporting CNAME lookups. It
+// is optional so existing DNSResolver implementations keep working for host
+// and address lookups.
+type CNAMEResolver interface {
+	LookupCNAME(ctx context.Context, host string) (cname string, err error)
+}
+
+// ErrNotSupported is returned when the configured DNSResolver does not
+// implement the interface required by a lookup.
+var ErrNotSupported = errors.New("dnscache: lookup not supported by resolver")
+
+// ErrInvalidName is wrapped by the error returned by host lookups of an empty
+// or malformed name, or of a name longer than 253 bytes, and by reverse
+// lookups of a string that is not an IP address. Such lookups fail without
+// touching the cache or the upstream resolver.
+var ErrInvalidName = errors.New("dnscache: invalid name")
+
+// Resolver is a DNS resolver caching the results of an upstream DNSResolver.
+// The zero value is ready to use with a cache of 1000 entries; use New or
+// NewDNSResolver to configure the cache.
 type Resolver struct {
-	// Timeout defines the maximum allowed time allowed for a lookup.
+	// stats is accessed atomically and must stay 64-bit aligned.
+	stats Stats
+
+	// Timeout defines the maximum allowed time allowed for a lookup. A
+	// deadline set on the context passed to a lookup is honored as well, so
+	// callers can use shorter per-call timeouts.
 	Timeout time.Duration
 
 	// Resolver is used to perform actual DNS lookup. If nil,
 	// net.DefaultResolver is used instead.
 	Resolver DNSResolver
 
-	once  sync.Once
-	mu    sync.RWMutex
-	cache *lru.Cache
+	// TTL defines how long an entry is served from the cache before a new
+	// lookup is performed. If TTL <= 0, entries never expire and are only
+	// removed by LRU eviction, unless the Resolver reports record TTLs, see
+	// TTLResolver.
+	TTL time.Duration
+
+	// HostTTL and AddrTTL, if > 0, override TTL for host and reverse
+	// lookups respectively, e.g. to keep reverse entries, which change less
+	// often, for longer.
+	HostTTL time.Duration
+	AddrTTL time.Duration
+
+	// NegativeTTL defines how long a lookup failing with a not found error
+	// (NXDOMAIN) is cached. If NegativeTTL <= 0, the TTL of successful
+	// lookups is used instead.
+	NegativeTTL time.Duration
+
+	// TransientErrorTTL defines how long a lookup failing with any other
+	// error, such as a timeout or a server failure, is cached. If
+	// TransientErrorTTL <= 0, such failures are not cached.
+	TransientErrorTTL time.Duration
+
+	// MaxFailureBackoff, if > 0, makes failures of an entry failing
+	// repeatedly cached for longer: each consecutive failure doubles the
+	// time its error is cached, up to MaxFailureBackoff, randomized between
+	// half and all of it to spread retries. A successful lookup resets the
+	// backoff.
+	MaxFailureBackoff time.Duration
+
+	// Retries is the number of times an upstream lookup failing with a
+	// timeout or temporary error is retried, waiting RetryBackoff between
+	// attempts. Not found errors are never retried. All attempts share the
+	// same Timeout.
+	Retries      int
+	RetryBackoff time.Duration
+
+	// NoCache, if set, is called with the host, address or domain name of
+	// each lookup. If it returns true, the lookup is always made upstream
+	// and its result is not cached, though concurrent lookups of the same
+	// subject are still merged.
+	NoCache func(host string) bool
+
+	// Rewrite and RewriteAddr, if set, are called with the host of each
+	// LookupHost or the address of each LookupAddr before the cache is
+	// consulted, e.g. to block names, append a search domain or canonicalize
+	// names. The returned host or address is used both as the cache key and
+	// for the upstream query. If they return an error, the lookup fails with
+	// that error without being cached.
+	Rewrite     func(host string) (string, error)
+	RewriteAddr func(addr string) (string, error)
+
+	// CaseSensitive disables the case folding of names. By default, names
+	// are lowercased before being cached and looked up upstream, as DNS
+	// names are case-insensitive, so "Example.COM" and "example.com" share
+	// one cache entry. Reverse lookup addresses are never folded.
+	CaseSensitive bool
+
+	// NoCacheEmpty disables caching of successful lookups returning no
+	// records, so they are retried on the next lookup. By default, empty
+	// results are cached like any other.
+	NoCacheEmpty bool
+
+	// MinTTL and MaxTTL bound the lifetime of cache entries, whatever their
+	// TTL. MaxTTL also applies to entries that would otherwise never expire.
+	// Bounds <= 0 are ignored.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// RefreshConcurrency defines the maximum number of entries refreshed in
+	// parallel by Refresh. If RefreshConcurrency <= 0, entries are refreshed
+	// one at a time.
+	RefreshConcurrency int
+
+	// MaxConcurrentLookups limits the number of upstream lookups in flight
+	// at any time. Lookups waiting for a slot honor their context. If
+	// MaxConcurrentLookups <= 0, there is no limit. It must be set before
+	// the first lookup.
+	MaxConcurrentLookups int
+
+	// RefreshSkipErrors makes Refresh skip the entries holding a failed
+	// lookup, which are then only looked up again on demand once expired.
+	RefreshSkipErrors bool
+
+	// RefreshJitter randomizes entry expiries and the auto-refresh interval
+	// by up to ±RefreshJitter so that entries looked up, or resolvers
+	// started, at the same time are not refreshed at the same instant.
+	// Jittered lifetimes stay within MinTTL and MaxTTL.
+	RefreshJitter time.Duration
+
+	// AutoTune makes the auto-refresh goroutine call Tune on each tick,
+	// growing the cache up to MaxCacheSize entries while it is too small
+	// for the workload.
+	AutoTune     bool
+	MaxCacheSize int
+
+	// ServeStale makes lookups return the last successful result of a cached
+	// entry, even if expired, when the upstream lookup fails. The stale
+	// result is served for as long as the error would have been cached.
+	ServeStale bool
+
+	// StaleWhileRevalidate makes lookups of an expired entry holding a
+	// successful result return that result immediately while the entry is
+	// refreshed in the background.
+	StaleWhileRevalidate bool
+
+	// DisableSingleflight makes every cache miss perform its own upstream
+	// lookup instead of waiting for an identical lookup in flight, e.g. to
+	// load test the upstream.
+	DisableSingleflight bool
+
+	// CacheHealthCheck makes HealthCheck cache the result of its lookups.
+	CacheHealthCheck bool
+
+	// Validate, if set, is called with the host and addresses returned by
+	// each successful upstream host lookup before they are cached. If it
+	// returns an error, the lookup fails with that error, cached like any
+	// other non not-found error.
+	Validate func(key string, addrs []string) error
+
+	// Rand, if set, is the source of randomness of ShuffleAddresses and
+	// RefreshJitter, e.g. to make them reproducible. It is used under an
+	// internal lock. If nil, the default source of math/rand is used.
+	Rand *rand.Rand
+
+	// DedupeAddresses makes host lookups remove duplicate addresses from
+	// upstream answers before caching them, keeping the first occurrence of
+	// each.
+	DedupeAddresses bool
+
+	// NormalizeNames makes LookupAddr lowercase the returned names, strip
+	// their trailing dot and remove duplicates before caching them.
+	NormalizeNames bool
+
+	// ShuffleAddresses randomizes the order of the addresses returned by
+	// LookupHost and LookupIP on each call to spread load across them. The
+	// cached order is left untouched.
+	ShuffleAddresses bool
+
+	// AddressFamily selects the order or filtering by address family of the
+	// addresses returned by LookupHost and LookupIP. It applies after
+	// ShuffleAddresses and leaves the cached order untouched.
+	AddressFamily AddressFamily
+
+	// Tracer, if set, is used to start a span for each lookup.
+	Tracer Tracer
+
+	// Logger, if set, receives an event for each lookup.
+	Logger Logger
+
+	// WAL, if set, receives a JSON line recording the records, expiry and
+	// lookup time of each successful result stored in the cache, so that
+	// ReplayWAL can rebuild the cache after a restart. Writes are serialized
+	// and their errors ignored. The log is append-only; it can be truncated
+	// after writing a snapshot with Save.
+	WAL io.Writer
+
+	// Metrics, if set, receives cache hits and misses, upstream lookup
+	// latencies and the cache size.
+	Metrics Metrics
+
+	once      sync.Once
+	shards    []*shard
+	numShards int
+
+	// sizeMu guards cacheSize once the Resolver is in use, and serializes
+	// calls to Resize.
+	sizeMu    sync.Mutex
+	cacheSize int
+
+	// addrShards are the last shards of shards, holding reverse lookups if
+	// WithAddrCacheSize was given.
+	addrShards    []*shard
+	addrCacheSize int
+
+	// maxBytes is the estimated size the cache is bounded by, if set with
+	// WithMaxBytes.
+	maxBytes int
+
+	// evictionPolicy is the policy of the default cache, set with
+	// WithEvictionPolicy.
+	evictionPolicy EvictionPolicy
+
+	// lookupGroup merges lookup calls together for lookups for the same key.
+	lookupGroup singleflight.Group
+
+	// revalidateMu guards revalidating, the set of keys being refreshed in
+	// the background for StaleWhileRevalidate.
+	revalidateMu sync.Mutex
+	revalidating map[cacheKey]bool
+
+	// inFlightMu guards inFlight, the number of upstream lookups executing
+	// for each key.
+	inFlightMu sync.Mutex
+	inFlight   map[cacheKey]int
+
+	// walMu serializes writes to WAL.
+	walMu sync.Mutex
+
+	// randMu guards Rand.
+	randMu sync.Mutex
+
+	// overrideMu guards overrides, the TTLs set with SetTTL. It is created
+	// on first use.
+	overrideMu sync.Mutex
+	overrides  *lru.Cache
+
+	// tuneMu guards tuneStats, the counters at the previous Tune step, and
+	// tuneSkip, set when that step resized the cache.
+	tuneMu    sync.Mutex
+	tuneStats Stats
+	tuneSkip  bool
+
+	// sem limits the number of concurrent upstream lookups to
+	// MaxConcurrentLookups. It is created on first use.
+	semOnce sync.Once
+	sem     chan struct{}
+
+	// closed is set atomically by Close.
+	closed int32
+
+	// refreshMu guards the auto-refresh goroutine channels.
+	refreshMu   sync.Mutex
+	refreshStop chan struct{}
+	refreshDone chan struct{}
+
+	// OnEvict, if set, is called with the host, address or domain name of
+	// entries evicted to make room for new ones. It is called after the
+	// cache lock is released, so it may call the Resolver. It is not called
+	// for entries removed explicitly, nor for caches set with WithCache.
+	OnEvict func(key string)
 
 	// OnCacheMiss is executed if the host or address is not included in
-	// the cache and the default lookup is executed.
+	// the cache and the default lookup is executed. It is called by the
+	// looking up goroutine before the upstream lookup starts.
 	OnCacheMiss func()
+
+	// OnCacheHit is executed if the host or address is served from the
+	// cache. It is called by the looking up goroutine before the lookup
+	// returns.
+	OnCacheHit func()
+
+	// AsyncCallbacks makes OnCacheMiss and OnCacheHit run in their own
+	// goroutine so slow callbacks do not delay lookups. They may then run
+	// concurrently with each other and after the lookup returned, in no
+	// particular order.
+	AsyncCallbacks bool
+
+	// OnLookup, if set, is called after every lookup with its kind, one of
+	// the Kind constants, its subject, the returned records, formatted as in
+	// EntrySnapshot, its error and whether it was served from the cache.
+	OnLookup func(kind byte, subject string, addrs []string, err error, hit bool)
+
+	// clock tells the current time. If nil, systemClock is used.
+	clock Clock
+}
+
+// Stats holds the cache counters of a Resolver since its creation.
+type Stats struct {
+	// Hits is the number of lookups served from the cache.
+	Hits uint64
+	// Misses is the number of lookups not found in the cache.
+	Misses uint64
+	// Evictions is the number of entries evicted from the cache to make
+	// room for new ones.
+	Evictions uint64
+}
+
+// Kinds identify the type of lookup a cache entry holds.
+const (
+	KindHost  byte = 'h'
+	KindAddr  byte = 'r'
+	KindCNAME byte = 'c'
+	KindMX    byte = 'm'
+	KindTXT   byte = 't'
+	KindNS    byte = 'n'
+	KindSRV   byte = 's'
+	KindPort  byte = 'p'
+)
+
+// cacheKey identifies a cache entry by lookup kind and subject.
+type cacheKey struct {
+	kind    byte
+	subject string
 }
 
+// key returns the cache key for a lookup of subject, folding its case unless
+// CaseSensitive is set or subject is an address.
+func (r *Resolver) key(kind byte, subject string) cacheKey {
+	if !r.CaseSensitive && kind != KindAddr {
+		subject = strings.ToLower(subject)
+	}
+	return cacheKey{kind: kind, subject: subject}
+}
+
+// String returns the key in the "<kind><subject>" form used as the
+// singleflight key. Because kind is always a single byte, the form is
+// unambiguous.
+func (k cacheKey) String() string {
+	return string(k.kind) + k.subject
+}
+
+// cacheEntry holds the result of a lookup. The type of val depends on the
+// kind of the lookup: []string for hosts, addresses and TXT records, string
+// for CNAMEs, []*net.MX, []*net.NS and srvResult for MX, NS and SRV records,
+// and int for ports.
 type cacheEntry struct {
-	rrs []string
-	err error
+	val    interface{}
+	err    error
+	expire time.Time
+	// storedAt is the time the entry was last looked up upstream.
+	storedAt time.Time
+	// failures is the number of consecutive failed lookups stored in the
+	// entry.
+	failures int
+}
+
+// copyValue returns a deep copy of a cached value.
+func copyValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case []string:
+		if v == nil {
+			return v
+		}
+		return append([]string(nil), v...)
+	case []*net.MX:
+		c := make([]*net.MX, len(v))
+		for i, mx := range v {
+			m := *mx
+			c[i] = &m
+		}
+		return c
+	case []*net.NS:
+		c := make([]*net.NS, len(v))
+		for i, ns := range v {
+			n := *ns
+			c[i] = &n
+		}
+		return c
+	case srvResult:
+		c := make([]*net.SRV, len(v.addrs))
+		for i, srv := range v.addrs {
+			s := *srv
+			c[i] = &s
+		}
+		return srvResult{cname: v.cname, addrs: c}
+	}
+	return val
+}
+
+// expired reports whether the entry has passed its expiry time. Entries with
+// a zero expiry never expire.
+func (e *cacheEntry) expired(now time.Time) bool {
+	return !e.expire.IsZero() && !now.Before(e.expire)
+}
+
+// New creates a new Resolver configured with opts. Unless WithCache,
+// WithCacheSize or WithMaxBytes is given, the cache holds up to 1000
+// entries. Unless WithCache or WithShards is given, the cache is split in up
+// to GOMAXPROCS shards of at least 128 entries.
+func New(opts ...Option) (*Resolver, error) {
+	r := &Resolver{}
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+	if r.cacheSize == 0 {
+		r.cacheSize = defaultCacheSize
+		if r.maxBytes > 0 {
+			r.cacheSize = maxBytesCacheSize
+		}
+	}
+	// built holds the shards created here, the only ones bounded by
+	// maxBytes: a cache set with WithCache does not report its evictions to
+	// the shard, which could then not keep track of its size.
+	var built []*shard
+	if r.shards == nil {
+		shards, err := newShards(r.numShards, r.cacheSize, r.evictionPolicy)
+		if err != nil {
+			return nil, err
+		}
+		r.shards = shards
+		built = shards
+	}
+	if r.addrCacheSize > 0 {
+		shards, err := newShards(r.numShards, r.addrCacheSize, r.evictionPolicy)
+		if err != nil {
+			return nil, err
+		}
+		r.shards = append(r.shards, shards...)
+		r.addrShards = shards
+		built = append(built, shards...)
+	}
+	if r.maxBytes > 0 {
+		for i, maxBytes := range splitSize(r.maxBytes, len(built)) {
+			if maxBytes == 0 {
+				maxBytes = 1
+			}
+			built[i].maxBytes = maxBytes
+		}
+	}
+	return r, nil
 }
 
-// NewDNSResolver create a new Resolver with the given cacheSize.
+// NewDNSResolver create a new Resolver with the given cacheSize. If cacheSize
+// is not positive, the cache holds up to 1000 entries as with New.
 func NewDNSResolver(cacheSize int) *Resolver {
-	cache, _ := lru.New(cacheSize)
-	return &Resolver{
-		cache: cache,
+	if cacheSize <= 0 {
+		cacheSize = defaultCacheSize
 	}
+	r, _ := New(WithCacheSize(cacheSize))
+	return r
 }
 
 // LookupAddr performs a reverse lookup for the given address, returning a list
 // of names mapping to that address.
 func (r *Resolver) LookupAddr(ctx context.Context, addr string) (names []string, err error) {
-	return r.lookup(ctx, "r"+addr)
+	names, _, err = r.LookupAddrCached(ctx, addr)
+	return
+}
+
+// LookupAddrCached is like LookupAddr, also reporting whether the result was
+// served from the cache.
+func (r *Resolver) LookupAddrCached(ctx context.Context, addr string) (names []string, hit bool, err error) {
+	if r.RewriteAddr != nil {
+		if addr, err = r.RewriteAddr(addr); err != nil {
+			return nil, false, err
+		}
+	}
+	if _, ok := parseIPAddr(addr); !ok {
+		return nil, false, fmt.Errorf("%w: %q is not an IP address", ErrInvalidName, addr)
+	}
+	val, hit, err := r.lookup(ctx, r.key(KindAddr, addr))
+	names, _ = val.([]string)
+	return
 }
 
 // LookupHost looks up the given host using the local resolver. It returns a
 // slice of that host's addresses.
 func (r *Resolver) LookupHost(ctx context.Context, host string) (addrs []string, err error) {
-	return r.lookup(ctx, "h"+host)
+	addrs, _, err = r.LookupHostCached(ctx, host)
+	return
+}
+
+// LookupHostCached is like LookupHost, also reporting whether the result was
+// served from the cache.
+func (r *Resolver) LookupHostCached(ctx context.Context, host string) (addrs []string, hit bool, err error) {
+	if host, err = r.rewrite(host); err != nil {
+		return nil, false, err
+	}
+	val, hit, err := r.lookup(ctx, r.key(KindHost, host))
+	addrs, _ = val.([]string)
+	if err == nil {
+		addrs, err = r.orderAddrs(host, addrs)
+	}
+	return
+}
+
+// LookupHostStale is like LookupHost, also reporting whether the addresses
+// come from an expired entry. If the upstream lookup of an expired entry
+// fails, the addresses it still holds are returned as stale instead of the
+// error, whether ServeStale is set or not. Once the Resolver is closed, it
+// fails with ErrClosed like LookupHost.
+func (r *Resolver) LookupHostStale(ctx context.Context, host string) (addrs []string, stale bool, err error) {
+	if host, err = r.rewrite(host); err != nil {
+		return nil, false, err
+	}
+	key := r.key(KindHost, host)
+	val, _, stale, err := r.lookupStale(ctx, key)
+	if err != nil && err != ErrClosed && ctx.Err() == nil {
+		if old, ok := r.loadStale(key); ok {
+			val, stale, err = copyValue(old), true, nil
+		}
+	}
+	addrs, _ = val.([]string)
+	if err == nil {
+		addrs, err = r.orderAddrs(host, addrs)
+	}
+	return
+}
+
+// TryLookupHost returns the cached addresses of host without ever looking it
+// up upstream. ok is false if host is not cached, its entry expired or holds
+// a failed lookup, letting the caller decide whether to call LookupHost. It
+// neither updates Stats nor calls OnCacheHit or OnCacheMiss. ok is always
+// false once the Resolver is closed.
+func (r *Resolver) TryLookupHost(host string) (addrs []string, ok bool) {
+	if r.isClosed() {
+		return nil, false
+	}
+	host, err := r.rewrite(host)
+	if err != nil {
+		return nil, false
+	}
+	val, found, err := r.load(r.key(KindHost, host))
+	if !found || err != nil {
+		return nil, false
+	}
+	addrs, _ = copyValue(val).([]string)
+	if addrs, err = r.orderAddrs(host, addrs); err != nil {
+		return nil, false
+	}
+	return addrs, true
+}
+
+// rewrite applies Rewrite, if set, to host and validates the result.
+func (r *Resolver) rewrite(host string) (string, error) {
+	if r.Rewrite != nil {
+		var err error
+		if host, err = r.Rewrite(host); err != nil {
+			return "", err
+		}
+	}
+	return host, validName(host)
+}
+
+// maxNameLen is the maximum length of a domain name, without trailing dot.
+const maxNameLen = 253
+
+// validName returns an error wrapping ErrInvalidName if host is empty, longer
+// than maxNameLen or holds control characters.
+func validName(host string) error {
+	name := strings.TrimSuffix(host, ".")
+	if name == "" {
+		return fmt.Errorf("%w: empty host", ErrInvalidName)
+	}
+	if len(name) > maxNameLen {
+		return fmt.Errorf("%w: host longer than %d bytes", ErrInvalidName, maxNameLen)
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < ' ' || c == 0x7f {
+			return fmt.Errorf("%w: control character in host %q", ErrInvalidName, host)
+		}
+	}
+	return nil
+}
+
+// LookupCNAME returns the canonical name for the given host. It returns
+// ErrNotSupported if the configured Resolver does not implement
+// CNAMEResolver.
+func (r *Resolver) LookupCNAME(ctx context.Context, host string) (cname string, err error) {
+	if _, ok := r.resolver(ctx).(CNAMEResolver); !ok {
+		return "", ErrNotSupported
+	}
+	val, _, err := r.lookup(ctx, r.key(KindCNAME, host))
+	cname, _ = val.(string)
+	return
+}
+
+// LookupIP looks up host for the given network using the local resolver. It
+// returns a slice of that host's IP addresses of the type specified by
+// network. network must be one of "ip", "ip4" or "ip6".
+func (r *Resolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	switch network {
+	case "ip", "ip4", "ip6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		isIP4 := ip.To4() != nil
+		if (network == "ip4" && !isIP4) || (network == "ip6" && isIP4) {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 && len(addrs) > 0 {
+		return nil, &net.DNSError{Err: "no suitable address found", Name: host}
+	}
+	return ips, nil
+}
+
+// LookupIPAddr looks up host using the local resolver. It returns a slice of
+// that host's IPv4 and IPv6 addresses, keeping the zone of scoped IPv6
+// addresses such as "fe80::1%eth0". It shares the cache of LookupHost.
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		if ip, ok := parseIPAddr(addr); ok {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 && len(addrs) > 0 {
+		return nil, &net.DNSError{Err: "no suitable address found", Name: host}
+	}
+	return ips, nil
 }
 
-// Refresh refreshes all cached entries
+// parseIPAddr parses an IP address with an optional IPv6 zone.
+func parseIPAddr(s string) (net.IPAddr, bool) {
+	var zone string
+	if i := strings.LastIndexByte(s, '%'); i >= 0 {
+		s, zone = s[:i], s[i+1:]
+	}
+	ip := net.ParseIP(s)
+	if ip == nil || (zone != "" && ip.To4() != nil) {
+		return net.IPAddr{}, false
+	}
+	return net.IPAddr{IP: ip, Zone: zone}, true
+}
+
+// HealthCheck looks up host upstream, bypassing the cache, and returns the
+// lookup error, if any. It is meant for readiness probes checking that DNS
+// resolution works. Like other upstream lookups, it is subject to Retries
+// and MaxConcurrentLookups and reported to Metrics. The result is only cached
+// if CacheHealthCheck is set.
+func (r *Resolver) HealthCheck(ctx context.Context, host string) error {
+	if r.isClosed() {
+		return ErrClosed
+	}
+	host, err := r.rewrite(host)
+	if err != nil {
+		return err
+	}
+	key := r.key(KindHost, host)
+	defer r.trackInFlight(key)()
+	val, err := r.guard(ctx, r.retry(ctx, key))()
+	val, dnsTTL, err := r.result(key, val, err)
+	if r.CacheHealthCheck && ctx.Err() == nil {
+		r.store(key, val, err, dnsTTL)
+	}
+	return err
+}
+
+// Refresh refreshes all cached entries, except failed ones if
+// RefreshSkipErrors is set. Up to RefreshConcurrency entries are refreshed in
+// parallel. Refreshes share in-flight upstream lookups with concurrent cache
+// misses, so each key is looked up at most once at a time. Refresh does
+// nothing once the Resolver is closed.
 func (r *Resolver) Refresh() {
-	for _, key := range r.cache.Keys() {
-		r.update(context.Background(), key.(string))
+	if r.isClosed() {
+		return
+	}
+	workers := r.RefreshConcurrency
+	if workers < 1 {
+		workers = 1
 	}
+	keys := make(chan cacheKey)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				r.update(context.Background(), key)
+			}
+		}()
+	}
+	for _, key := range r.keys() {
+		if r.RefreshSkipErrors && r.failed(key) {
+			continue
+		}
+		keys <- key
+	}
+	close(keys)
+	wg.Wait()
 }
 
-// lookupGroup merges lookup calls together for lookups for the same host. The
-// lookupGroup key is is the LookupIPAddr.host argument.
-var lookupGroup singleflight.Group
+// RefreshKey looks up host upstream, waits for the result and stores it in
+// the cache like Refresh does for every entry, leaving the other entries
+// untouched. It returns the fresh addresses, ordered as by LookupHost. It
+// shares an in-flight upstream lookup of host, if any.
+func (r *Resolver) RefreshKey(ctx context.Context, host string) ([]string, error) {
+	if r.isClosed() {
+		return nil, ErrClosed
+	}
+	host, err := r.rewrite(host)
+	if err != nil {
+		return nil, err
+	}
+	val, _, err := r.update(ctx, r.key(KindHost, host))
+	addrs, _ := copyValue(val).([]string)
+	if err != nil {
+		return nil, err
+	}
+	return r.orderAddrs(host, addrs)
+}
 
-func (r *Resolver) lookup(ctx context.Context, key string) (rrs []string, err error) {
-	var found bool
-	rrs, found, err = r.load(key)
-	if !found {
+// RefreshAddrKey is like RefreshKey for the reverse lookup of addr.
+func (r *Resolver) RefreshAddrKey(ctx context.Context, addr string) ([]string, error) {
+	if r.isClosed() {
+		return nil, ErrClosed
+	}
+	if r.RewriteAddr != nil {
+		var err error
+		if addr, err = r.RewriteAddr(addr); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := parseIPAddr(addr); !ok {
+		return nil, fmt.Errorf("%w: %q is not an IP address", ErrInvalidName, addr)
+	}
+	val, _, err := r.update(ctx, r.key(KindAddr, addr))
+	names, _ := copyValue(val).([]string)
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// failed reports whether the entry for key holds a failed lookup.
+func (r *Resolver) failed(key cacheKey) bool {
+	s := r.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, found := s.peek(key)
+	return found && entry.(*cacheEntry).err != nil
+}
+
+func (r *Resolver) lookup(ctx context.Context, key cacheKey) (val interface{}, hit bool, err error) {
+	val, hit, _, err = r.lookupStale(ctx, key)
+	return
+}
+
+// lookupStale is like lookup, also reporting whether the result comes from
+// an expired entry, served by StaleWhileRevalidate or ServeStale.
+func (r *Resolver) lookupStale(ctx context.Context, key cacheKey) (val interface{}, hit, stale bool, err error) {
+	if r.isClosed() {
+		return nil, false, false, ErrClosed
+	}
+	start := time.Now()
+	ctx, span := r.startSpan(ctx, key)
+	defer func() {
+		// Never hand out the cached value itself, so callers may modify
+		// the result without corrupting the cache.
+		val = copyValue(val)
+		endSpan(span, hit, val, err)
+		r.logLookup(ctx, key, hit, start, val, err)
+		if r.OnLookup != nil {
+			r.OnLookup(key.kind, key.subject, formatRecords(val), err, hit)
+		}
+	}()
+	_, scoped := contextResolver(ctx)
+	if !forceRefresh(ctx) && !scoped && !r.noCache(key) {
+		val, hit, err = r.load(key)
+		if !hit && r.StaleWhileRevalidate {
+			if val, hit = r.loadStale(key); hit {
+				stale = true
+				r.revalidate(key)
+			}
+		}
+	}
+	if hit {
+		atomic.AddUint64(&r.stats.Hits, 1)
+		r.metrics().IncHit()
+		if r.OnCacheHit != nil {
+			r.callback(r.OnCacheHit)
+		}
+	} else {
+		atomic.AddUint64(&r.stats.Misses, 1)
+		r.metrics().IncMiss()
 		if r.OnCacheMiss != nil {
-			r.OnCacheMiss()
+			r.callback(r.OnCacheMiss)
+		}
+		if scoped {
+			val, err = r.lookupUncached(ctx, key)
+		} else {
+			val, stale, err = r.update(ctx, key)
 		}
-		rrs, err = r.update(ctx, key)
 	}
 	return
 }
 
-func (r *Resolver) update(ctx context.Context, key string) (rrs []string, err error) {
-	c := lookupGroup.DoChan(key, r.lookupFunc(key))
+// trackInFlight records an upstream lookup of key as executing until the
+// returned function is called.
+func (r *Resolver) trackInFlight(key cacheKey) func() {
+	r.inFlightMu.Lock()
+	if r.inFlight == nil {
+		r.inFlight = make(map[cacheKey]int)
+	}
+	r.inFlight[key]++
+	r.inFlightMu.Unlock()
+	return func() {
+		r.inFlightMu.Lock()
+		if r.inFlight[key]--; r.inFlight[key] == 0 {
+			delete(r.inFlight, key)
+		}
+		r.inFlightMu.Unlock()
+	}
+}
+
+// InFlight returns the sorted subjects of the upstream lookups currently
+// executing, e.g. to spot a hung upstream. Each subject is reported once,
+// however many lookups of it are executing.
+func (r *Resolver) InFlight() []string {
+	r.inFlightMu.Lock()
+	subjects := make([]string, 0, len(r.inFlight))
+	seen := make(map[string]bool, len(r.inFlight))
+	for key := range r.inFlight {
+		if !seen[key.subject] {
+			seen[key.subject] = true
+			subjects = append(subjects, key.subject)
+		}
+	}
+	r.inFlightMu.Unlock()
+	sort.Strings(subjects)
+	return subjects
+}
+
+// callback calls fn, in its own goroutine if AsyncCallbacks is set.
+func (r *Resolver) callback(fn func()) {
+	if r.AsyncCallbacks {
+		go fn()
+		return
+	}
+	fn()
+}
+
+// noCache reports whether the NoCache predicate excludes key from the cache.
+func (r *Resolver) noCache(key cacheKey) bool {
+	return r.NoCache != nil && r.NoCache(key.subject)
+}
+
+// lookupUncached performs the upstream lookup for key without going through
+// the cache, for lookups using a resolver set with ContextWithResolver.
+func (r *Resolver) lookupUncached(ctx context.Context, key cacheKey) (interface{}, error) {
+	val, err := r.guard(ctx, r.retry(ctx, key))()
+	val, _, err = r.result(key, val, err)
+	return val, err
+}
+
+// update performs the upstream lookup for key and stores its result. The
+// upstream call is driven by the context of the caller starting it, which
+// also stores the result even if no caller waits for it anymore. Callers only
+// wait on their own context, and for at most Timeout if set.
+func (r *Resolver) update(ctx context.Context, key cacheKey) (val interface{}, stale bool, err error) {
+	wait := ctx
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		wait, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	return r.updateUntil(ctx, wait, key)
+}
+
+// updateUntil is like update, waiting for the result until wait is done.
+func (r *Resolver) updateUntil(ctx, wait context.Context, key cacheKey) (val interface{}, stale bool, err error) {
+	lookup := r.guard(ctx, r.retry(ctx, key))
+	fn := func() (interface{}, error) {
+		defer r.trackInFlight(key)()
+		val, err := lookup()
+		val, dnsTTL, err := r.result(key, val, err)
+		if err != nil && ctx.Err() != nil {
+			// The lookup was aborted by the caller, not answered. Errors
+			// wrapping a context error are otherwise genuine failures, such
+			// as the upstream running out of Timeout.
+			return abortedValue{}, err
+		}
+		if r.noCache(key) {
+			return val, err
+		}
+		val, stale, err := r.store(key, val, err, dnsTTL)
+		if stale {
+			return staleValue{val}, err
+		}
+		return val, err
+	}
+	var c <-chan singleflight.Result
+	if r.DisableSingleflight {
+		ch := make(chan singleflight.Result, 1)
+		go func() {
+			val, err := fn()
+			ch <- singleflight.Result{Val: val, Err: err}
+		}()
+		c = ch
+	} else {
+		c = r.lookupGroup.DoChan(key.String(), fn)
+	}
 	select {
-	case <-ctx.Done():
-		err = ctx.Err()
-		if err == context.DeadlineExceeded {
-			// If DNS request timed out for some reason, force future
-			// request to start the DNS lookup again rather than waiting
-			// for the current lookup to complete.
-			lookupGroup.Forget(key)
+	case <-wait.Done():
+		err = wait.Err()
+		// If DNS request timed out or was cancelled for some reason, force
+		// future request to start the DNS lookup again rather than waiting
+		// for the current lookup to complete.
+		r.lookupGroup.Forget(key.String())
+		if ctx.Err() == nil && r.ServeStale {
+			// Timeout expired: the lookup failed for this caller.
+			if old, ok := r.loadStale(key); ok {
+				return old, true, nil
+			}
 		}
 	case res := <-c:
-		if res.Shared {
-			// We had concurrent lookups, check if the cache is already updated
-			// by a friend.
-			var found bool
-			rrs, found, err = r.load(key)
-			if found {
-				return
+		if _, ok := res.Val.(abortedValue); ok {
+			if ctx.Err() == nil {
+				// The caller driving the shared lookup went away; this
+				// caller is still interested, so start a lookup of its
+				// own, still waiting no longer than wait.
+				r.lookupGroup.Forget(key.String())
+				return r.updateUntil(ctx, wait, key)
 			}
+			return nil, false, res.Err
 		}
-		err = res.Err
-		if err == nil {
-			rrs, _ = res.Val.([]string)
+		val, err = res.Val, res.Err
+		if sv, ok := val.(staleValue); ok {
+			val, stale = sv.val, true
 		}
-		r.mu.Lock()
-		r.storeLocked(key, rrs, err)
-		r.mu.Unlock()
 	}
 	return
 }
 
-// lookupFunc returns lookup function for key. The type of the key is stored as
-// the first char and the lookup subject is the rest of the key.
-func (r *Resolver) lookupFunc(key string) func() (interface{}, error) {
-	if len(key) == 0 {
-		panic("lookupFunc with empty key")
+// staleValue wraps the result of a shared lookup served from a stale entry.
+type staleValue struct {
+	val interface{}
+}
+
+// abortedValue is the result of a shared lookup aborted because the context
+// of the caller driving it is done.
+type abortedValue struct{}
+
+// result returns the value and DNS TTL of the result of an upstream lookup
+// for key, normalized and validated if configured. The DNS TTL is noTTL if
+// unknown.
+func (r *Resolver) result(key cacheKey, val interface{}, err error) (interface{}, time.Duration, error) {
+	if err != nil {
+		return nil, noTTL, err
+	}
+	dnsTTL := noTTL
+	if tr, ok := val.(ttlResult); ok {
+		val, dnsTTL = tr.val, tr.ttl
+	}
+	if names, ok := val.([]string); ok && key.kind == KindAddr && r.NormalizeNames {
+		val = normalizeNames(names)
 	}
+	if addrs, ok := val.([]string); ok && key.kind == KindHost && r.DedupeAddresses {
+		val = dedupe(append([]string(nil), addrs...))
+	}
+	if addrs, ok := val.([]string); ok && key.kind == KindHost && r.Validate != nil {
+		if err = r.Validate(key.subject, addrs); err != nil {
+			return nil, noTTL, err
+		}
+	}
+	return val, dnsTTL, nil
+}
 
-	var resolver DNSResolver = net.DefaultResolver
-	if r.Resolver != nil {
-		resolver = r.Resolver
+// store caches the result of an upstream lookup for key and returns the
+// result to hand to the caller, which is the last good result instead of err
+// with ServeStale, reported as stale. dnsTTL is the TTL of the returned
+// records, or noTTL if unknown.
+//
+// store is the only place lookup results enter the cache. The decision to
+// serve a stale entry and the write of the new entry are made under the
+// write lock of the shard holding key, so concurrent stores for the same key,
+// e.g. from Refresh and LookupHost, are serialized and the last one wins.
+// Readers only access entries under the read lock, and cached values are
+// replaced rather than modified, so values handed out after the lock is
+// released are never written to.
+func (r *Resolver) store(key cacheKey, val interface{}, err error, dnsTTL time.Duration) (interface{}, bool, error) {
+	_, cacheable := r.ttl(key.kind, err)
+	if err == nil && r.NoCacheEmpty && resultCount(val) == 0 {
+		cacheable = false
 	}
+	s := r.shard(key)
+	s.mu.Lock()
+	if err != nil && r.ServeStale {
+		if stale, ok := r.staleLocked(key); ok {
+			// Keep serving the last known good result rather than the
+			// error, and retry once the error entry would have expired.
+			if cacheable {
+				e := *stale
+				e.expire = r.expiry(key.kind, err, noTTL)
+				s.cache.Add(key, &e)
+			}
+			val = stale.val
+			s.mu.Unlock()
+			return val, true, nil
+		}
+	}
+	var evicted []cacheKey
+	var e *cacheEntry
+	if cacheable {
+		e = r.storeLocked(key, val, err, dnsTTL)
+		evicted = s.takeEvicted()
+	}
+	s.mu.Unlock()
+	if cacheable {
+		r.reportSize()
+		r.notifyEvicted(evicted)
+		r.appendWAL(key, e)
+	}
+	return val, false, err
+}
 
-	switch key[0] {
-	case 'h':
+// lookupFunc returns lookup function for key. The lookup is bound to ctx and
+// Timeout.
+func (r *Resolver) lookupFunc(ctx context.Context, key cacheKey) func() (interface{}, error) {
+	resolver := r.resolver(ctx)
+	if fn := r.ttlLookupFunc(ctx, resolver, key); fn != nil {
+		return fn
+	}
+
+	switch key.kind {
+	case KindHost:
+		return func() (interface{}, error) {
+			ctx, cancel := r.getCtx(ctx)
+			defer cancel()
+			return resolver.LookupHost(ctx, key.subject)
+		}
+	case KindAddr:
 		return func() (interface{}, error) {
-			ctx, cancel := r.getCtx()
+			ctx, cancel := r.getCtx(ctx)
 			defer cancel()
-			return resolver.LookupHost(ctx, key[1:])
+			return resolver.LookupAddr(ctx, key.subject)
 		}
-	case 'r':
+	case KindCNAME:
 		return func() (interface{}, error) {
-			ctx, cancel := r.getCtx()
+			cr, ok := resolver.(CNAMEResolver)
+			if !ok {
+				return nil, ErrNotSupported
+			}
+			ctx, cancel := r.getCtx(ctx)
 			defer cancel()
-			return resolver.LookupAddr(ctx, key[1:])
+			return cr.LookupCNAME(ctx, key.subject)
 		}
 	default:
-		panic("lookupFunc invalid key type: " + key)
+		if fn := r.recordLookupFunc(ctx, resolver, key); fn != nil {
+			return fn
+		}
+		panic("lookupFunc invalid key type: " + key.String())
+	}
+}
+
+// guard wraps the upstream lookup fn driven by ctx. The returned function
+// waits for one of the MaxConcurrentLookups slots to be available, or for ctx
+// to be done, before running fn. If fn fails because ctx is done, the context
+// error is returned instead of the one of the upstream resolver so the failure
+// is not mistaken for, and cached as, a DNS error.
+func (r *Resolver) guard(ctx context.Context, fn func() (interface{}, error)) func() (interface{}, error) {
+	r.semOnce.Do(func() {
+		if r.MaxConcurrentLookups > 0 {
+			r.sem = make(chan struct{}, r.MaxConcurrentLookups)
+		}
+	})
+	return func() (interface{}, error) {
+		if r.sem != nil {
+			select {
+			case r.sem <- struct{}{}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			defer func() { <-r.sem }()
+		}
+		start := time.Now()
+		val, err := fn()
+		r.metrics().ObserveLookup(time.Since(start), err)
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return val, err
+	}
+}
+
+// EffectiveResolver returns the DNSResolver used for upstream lookups: the
+// configured Resolver, or net.DefaultResolver if none is set. Resolvers set
+// on a lookup context with ContextWithResolver take precedence over it.
+func (r *Resolver) EffectiveResolver() DNSResolver {
+	return r.resolver(context.Background())
+}
+
+// resolver returns the DNSResolver used for upstream lookups made with ctx.
+func (r *Resolver) resolver(ctx context.Context) DNSResolver {
+	if resolver, ok := contextResolver(ctx); ok {
+		return resolver
+	}
+	if r.Resolver != nil {
+		return r.Resolver
 	}
+	return net.DefaultResolver
 }
 
-func (r *Resolver) getCtx() (ctx context.Context, cancel context.CancelFunc) {
-	ctx = context.Background()
+// getCtx returns the context of an upstream lookup, derived from the caller
+// context parent and bounded by Timeout if set. The lookup is thus cancelled
+// at the earlier of the parent deadline and Timeout.
+func (r *Resolver) getCtx(parent context.Context) (ctx context.Context, cancel context.CancelFunc) {
+	ctx = parent
 	if r.Timeout > 0 {
 		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
 	} else {
@@ -153,33 +1149,428 @@ func (r *Resolver) getCtx() (ctx context.Context, cancel context.CancelFunc) {
 	return
 }
 
-func (r *Resolver) load(key string) (rrs []string, found bool, err error) {
-	r.mu.RLock()
-	entry, found := r.cache.Get(key)
+// isContextErr reports whether err is a context cancellation or deadline
+// error.
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func (r *Resolver) load(key cacheKey) (val interface{}, found bool, err error) {
+	s := r.shard(key)
+	s.mu.RLock()
+	entry, found := s.cache.Get(key)
 	if !found {
-		r.mu.RUnlock()
+		s.mu.RUnlock()
 		return
 	}
-	rrs = entry.(*cacheEntry).rrs
-	err = entry.(*cacheEntry).err
-	r.mu.RUnlock()
-	return rrs, true, err
+	e := entry.(*cacheEntry)
+	if e.expired(r.getNow()) {
+		s.mu.RUnlock()
+		return nil, false, nil
+	}
+	val = e.val
+	err = e.err
+	s.mu.RUnlock()
+	return val, true, err
+}
+
+// storeLocked stores the result of a lookup for key, keeping the lightweight
+// form of err. dnsTTL is the TTL of the returned records, or noTTL if
+// unknown. It returns the stored entry. The lock of the shard of key must be
+// held.
+func (r *Resolver) storeLocked(key cacheKey, val interface{}, err error, dnsTTL time.Duration) *cacheEntry {
+	if ttl, ok := r.ttlOverride(key); ok && err == nil {
+		dnsTTL = ttl
+	}
+	err = lightError(err)
+	expire := r.expiry(key.kind, err, dnsTTL)
+	now := r.getNow()
+	s := r.shard(key)
+	entry, found := s.peek(key)
+	failures := 0
+	if err != nil {
+		failures = 1
+		if found && entry.(*cacheEntry).err != nil {
+			failures += entry.(*cacheEntry).failures
+		}
+		if failures > 1 && r.MaxFailureBackoff > 0 && !expire.IsZero() {
+			ttl, _ := r.ttl(key.kind, err)
+			expire = now.Add(r.clampTTL(r.failureBackoff(ttl, failures)))
+		}
+	}
+	// Entries are replaced rather than updated in place, as a Cache shared
+	// with other Resolvers is only guarded by the lock of each of them.
+	e := &cacheEntry{
+		val:      val,
+		err:      err,
+		expire:   expire,
+		storedAt: now,
+		failures: failures,
+	}
+	if evicted := s.add(key, e); evicted > 0 {
+		atomic.AddUint64(&r.stats.Evictions, uint64(evicted))
+	}
+	return e
 }
 
-func (r *Resolver) storeLocked(key string, rrs []string, err error) {
-	if entry, found := r.cache.Get(key); found {
-		// Update existing entry in place
-		entry.(*cacheEntry).rrs = rrs
-		entry.(*cacheEntry).err = err
+// loadStale returns the successful result cached for key, even if expired.
+func (r *Resolver) loadStale(key cacheKey) (val interface{}, found bool) {
+	s := r.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if e, ok := r.staleLocked(key); ok {
+		return e.val, true
+	}
+	return nil, false
+}
+
+// revalidate refreshes key in the background unless a refresh of key is
+// already running.
+func (r *Resolver) revalidate(key cacheKey) {
+	r.revalidateMu.Lock()
+	defer r.revalidateMu.Unlock()
+	if r.revalidating[key] {
 		return
 	}
-	r.cache.Add(key, &cacheEntry{
-		rrs: rrs,
-		err: err,
+	if r.revalidating == nil {
+		r.revalidating = map[cacheKey]bool{}
+	}
+	r.revalidating[key] = true
+	go func() {
+		r.update(context.Background(), key)
+		r.revalidateMu.Lock()
+		delete(r.revalidating, key)
+		r.revalidateMu.Unlock()
+	}()
+}
+
+// staleLocked returns the cached entry for key if it holds a successful
+// result, whether expired or not. The lock of the shard of key must be held.
+func (r *Resolver) staleLocked(key cacheKey) (*cacheEntry, bool) {
+	entry, found := r.shard(key).peek(key)
+	if !found || entry.(*cacheEntry).err != nil {
+		return nil, false
+	}
+	return entry.(*cacheEntry), true
+}
+
+// expiry returns the expiry time of an entry of the given kind storing a
+// lookup result with err and records with dnsTTL, or the zero time if the
+// entry never expires. A known dnsTTL takes precedence over the static TTL of
+// successful lookups.
+func (r *Resolver) expiry(kind byte, err error, dnsTTL time.Duration) time.Time {
+	ttl, _ := r.ttl(kind, err)
+	if err == nil && dnsTTL != noTTL {
+		ttl = dnsTTL
+		if ttl <= 0 {
+			// A zero record TTL means the entry must not be reused, rather
+			// than never expire.
+			if r.MinTTL <= 0 {
+				return r.getNow()
+			}
+			ttl = r.MinTTL
+		}
+	}
+	if ttl = r.clampTTL(ttl); ttl > 0 {
+		// Clamp the jittered TTL again so that jitter never takes it out
+		// of the MinTTL and MaxTTL bounds.
+		return r.getNow().Add(r.clampTTL(r.jitter(ttl)))
+	}
+	return time.Time{}
+}
+
+// failureBackoff returns the time the error of an entry is cached after
+// failures consecutive failures, doubling ttl for each failure after the
+// first, up to MaxFailureBackoff, with half of it randomized.
+func (r *Resolver) failureBackoff(ttl time.Duration, failures int) time.Duration {
+	if ttl <= 0 || ttl >= r.MaxFailureBackoff {
+		return ttl
+	}
+	for i := 1; i < failures && ttl < r.MaxFailureBackoff; i++ {
+		ttl *= 2
+	}
+	if ttl > r.MaxFailureBackoff {
+		ttl = r.MaxFailureBackoff
+	}
+	half := ttl / 2
+	return ttl - half + time.Duration(r.int63n(int64(half)+1))
+}
+
+// ttl returns the lifetime of an entry of the given kind storing a lookup
+// result with err, and whether the result should be cached at all.
+func (r *Resolver) ttl(kind byte, err error) (ttl time.Duration, cacheable bool) {
+	switch {
+	case err == nil:
+		return r.kindTTL(kind), true
+	case isNotFound(err):
+		if r.NegativeTTL > 0 {
+			return r.NegativeTTL, true
+		}
+		return r.kindTTL(kind), true
+	case r.TransientErrorTTL > 0:
+		return r.TransientErrorTTL, true
+	}
+	return 0, false
+}
+
+// kindTTL returns the static TTL of the successful lookups of the given kind.
+func (r *Resolver) kindTTL(kind byte) time.Duration {
+	switch {
+	case kind == KindHost && r.HostTTL > 0:
+		return r.HostTTL
+	case kind == KindAddr && r.AddrTTL > 0:
+		return r.AddrTTL
+	}
+	return r.TTL
+}
+
+// isNotFound reports whether err is a *net.DNSError for a name that does not
+// exist.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// normalizeNames returns names lowercased, without trailing dot and without
+// duplicates, in their original order.
+func normalizeNames(names []string) []string {
+	out := make([]string, len(names))
+	for i, name := range names {
+		out[i] = strings.ToLower(strings.TrimSuffix(name, "."))
+	}
+	return dedupe(out)
+}
+
+// dedupe returns values without duplicates, keeping the first occurrence of
+// each. values is modified in place.
+func dedupe(values []string) []string {
+	out := values[:0]
+	seen := make(map[string]bool, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// clampTTL bounds ttl to [MinTTL, MaxTTL]. A ttl <= 0 means the entry never
+// expires, which is bound by MaxTTL only.
+func (r *Resolver) clampTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		if r.MaxTTL > 0 {
+			return r.MaxTTL
+		}
+		return 0
+	}
+	if r.MinTTL > 0 && ttl < r.MinTTL {
+		ttl = r.MinTTL
+	}
+	if r.MaxTTL > 0 && ttl > r.MaxTTL {
+		ttl = r.MaxTTL
+	}
+	return ttl
+}
+
+// jitter returns d randomized by up to ±RefreshJitter, keeping it positive.
+func (r *Resolver) jitter(d time.Duration) time.Duration {
+	if r.RefreshJitter <= 0 {
+		return d
+	}
+	d += time.Duration(r.int63n(2*int64(r.RefreshJitter)+1)) - r.RefreshJitter
+	if d <= 0 {
+		d = 1
+	}
+	return d
+}
+
+// getNow returns the current time of the clock of the resolver.
+func (r *Resolver) getNow() time.Time {
+	if r.clock != nil {
+		return r.clock.Now()
+	}
+	return systemClock{}.Now()
+}
+
+// Clear removes all entries from the cache. Stats are not reset.
+func (r *Resolver) Clear() {
+	for _, s := range r.getShards() {
+		s.mu.Lock()
+		s.cache.Purge()
+		s.mu.Unlock()
+	}
+	r.reportSize()
+}
+
+// Expire marks all entries as expired without removing them, so the next
+// lookup of each is made upstream while their last successful result is
+// still available to ServeStale, StaleWhileRevalidate and LookupHostStale.
+func (r *Resolver) Expire() {
+	now := r.getNow()
+	for _, s := range r.getShards() {
+		s.mu.Lock()
+		for _, key := range s.cache.Keys() {
+			v, found := s.peek(key.(cacheKey))
+			if !found {
+				continue
+			}
+			e := *v.(*cacheEntry)
+			e.expire = now
+			s.cache.Add(key, &e)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Set caches addrs as the result of a successful lookup of host, expiring
+// after TTL like a looked up entry. The upstream resolver is not called.
+func (r *Resolver) Set(host string, addrs []string) {
+	r.set(r.key(KindHost, host), addrs)
+}
+
+// SetAddr caches names as the result of a successful reverse lookup of addr,
+// expiring after TTL like a looked up entry. The upstream resolver is not
+// called.
+func (r *Resolver) SetAddr(addr string, names []string) {
+	r.set(r.key(KindAddr, addr), names)
+}
+
+func (r *Resolver) set(key cacheKey, val []string) {
+	s := r.shard(key)
+	s.mu.Lock()
+	e := r.storeLocked(key, copyValue(val), nil, noTTL)
+	evicted := s.takeEvicted()
+	s.mu.Unlock()
+	r.reportSize()
+	r.notifyEvicted(evicted)
+	r.appendWAL(key, e)
+}
+
+// Remove removes the cached entry for host. It reports whether an entry was
+// present.
+func (r *Resolver) Remove(host string) bool {
+	return r.remove(r.key(KindHost, host))
+}
+
+// RemoveAddr removes the cached reverse lookup entry for addr. It reports
+// whether an entry was present.
+func (r *Resolver) RemoveAddr(addr string) bool {
+	return r.remove(r.key(KindAddr, addr))
+}
+
+func (r *Resolver) remove(key cacheKey) bool {
+	s := r.shard(key)
+	s.mu.Lock()
+	removed := s.cache.Remove(key)
+	s.mu.Unlock()
+	if removed {
+		r.reportSize()
+	}
+	return removed
+}
+
+// RemoveMatching removes the cached entries for which pred returns true,
+// e.g. all hosts under a domain, and returns the number of entries removed.
+// pred is called with the kind and subject of each entry while the cache is
+// locked, so it must not call the Resolver.
+func (r *Resolver) RemoveMatching(pred func(kind byte, subject string) bool) int {
+	removed := 0
+	for _, s := range r.getShards() {
+		s.mu.Lock()
+		for _, key := range s.cache.Keys() {
+			k := key.(cacheKey)
+			if pred(k.kind, k.subject) && s.cache.Remove(key) {
+				removed++
+			}
+		}
+		s.mu.Unlock()
+	}
+	if removed > 0 {
+		r.reportSize()
+	}
+	return removed
+}
+
+// Key identifies a cache entry.
+type Key struct {
+	// Kind is the type of lookup, one of the Kind constants.
+	Kind byte
+	// Subject is the looked up host, address or domain name.
+	Subject string
+}
+
+// Len returns the number of entries in the cache.
+func (r *Resolver) Len() int {
+	n := 0
+	for _, s := range r.getShards() {
+		s.mu.RLock()
+		n += s.cache.Len()
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// Keys returns the keys of the cache entries. With a single shard, keys are
+// ordered from oldest to newest.
+func (r *Resolver) Keys() []Key {
+	keys := r.keys()
+	out := make([]Key, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, Key{Kind: k.kind, Subject: k.subject})
+	}
+	return out
+}
+
+// SortedKeys is like Keys, returning the keys sorted by kind, then subject,
+// whatever the order in which entries were used, e.g. for stable display.
+func (r *Resolver) SortedKeys() []Key {
+	keys := r.Keys()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Kind != keys[j].Kind {
+			return keys[i].Kind < keys[j].Kind
+		}
+		return keys[i].Subject < keys[j].Subject
 	})
+	return keys
 }
 
-// GetCacheKeys returns the keys in the lru cache.
+// EntryInfo returns the records cached for key, whether expired or not, and
+// the time they were last looked up upstream. Records are only returned for
+// host, address and TXT entries; ok is false if key is not cached.
+func (r *Resolver) EntryInfo(key Key) (records []string, storedAt time.Time, ok bool) {
+	k := r.key(key.Kind, key.Subject)
+	s := r.shard(k)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, found := s.peek(k)
+	if !found {
+		return nil, time.Time{}, false
+	}
+	e := entry.(*cacheEntry)
+	records, _ = copyValue(e.val).([]string)
+	return records, e.storedAt, true
+}
+
+// Stats returns the cache counters accumulated since the resolver creation.
+// It is safe to call concurrently with lookups.
+func (r *Resolver) Stats() Stats {
+	return Stats{
+		Hits:      atomic.LoadUint64(&r.stats.Hits),
+		Misses:    atomic.LoadUint64(&r.stats.Misses),
+		Evictions: atomic.LoadUint64(&r.stats.Evictions),
+	}
+}
+
+// GetCacheKeys returns the keys in the cache. Each key is a string made of
+// the lookup kind followed by the subject: 'h' for hosts, 'r' for addresses,
+// 'c' for CNAMEs, 'm', 't', 'n' and 's' for MX, TXT, NS and SRV records, and
+// 'p' for service ports.
 func (r *Resolver) GetCacheKeys() []interface{} {
-	return r.cache.Keys()
+	keys := r.keys()
+	out := make([]interface{}, len(keys))
+	for i, key := range keys {
+		out[i] = key.String()
+	}
+	return out
 }
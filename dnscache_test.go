@@ -2,11 +2,230 @@ package dnscache
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math/rand"
 	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
+// errLookup is a not found error, cached like an NXDOMAIN answer.
+var errLookup = &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}
+
+// fakeResolver is a DNSResolver serving canned answers and counting the
+// number of upstream calls it receives.
+type fakeResolver struct {
+	mu     sync.Mutex
+	hosts  map[string][]string
+	addrs  map[string][]string
+	cnames map[string]string
+	mxs    map[string][]*net.MX
+	txts   map[string][]string
+	nss    map[string][]*net.NS
+	srvs   map[string][]*net.SRV
+	ports  map[string]int
+	err    error
+	calls  int
+	// delay is waited before answering host lookups.
+	delay time.Duration
+}
+
+func (f *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	time.Sleep(f.delay)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.hosts[host], nil
+}
+
+func (f *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.addrs[addr], nil
+}
+
+func (f *fakeResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.err != nil {
+		return "", f.err
+	}
+	return f.cnames[host], nil
+}
+
+func (f *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.mxs[name], nil
+}
+
+func (f *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.txts[name], nil
+}
+
+func (f *fakeResolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.nss[name], nil
+}
+
+// LookupSRV serves srvs keyed by the queried domain name.
+func (f *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.err != nil {
+		return "", nil, f.err
+	}
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+	return target + ".", f.srvs[target], nil
+}
+
+// LookupPort serves ports keyed by "network/service".
+func (f *fakeResolver) LookupPort(ctx context.Context, network, service string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.err != nil {
+		return 0, f.err
+	}
+	port, ok := f.ports[network+"/"+service]
+	if !ok {
+		return 0, &net.DNSError{Err: "unknown port", Name: network + "/" + service, IsNotFound: true}
+	}
+	return port, nil
+}
+
+func (f *fakeResolver) setHosts(hosts map[string][]string) {
+	f.mu.Lock()
+	f.hosts = hosts
+	f.mu.Unlock()
+}
+
+func (f *fakeResolver) setErr(err error) {
+	f.mu.Lock()
+	f.err = err
+	f.mu.Unlock()
+}
+
+func (f *fakeResolver) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// blockingResolver is a DNSResolver blocking all lookups until release is
+// closed.
+type blockingResolver struct {
+	addrs   []string
+	release chan struct{}
+	// started, if not nil, receives a value as each lookup starts.
+	started chan struct{}
+}
+
+func (b *blockingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if b.started != nil {
+		b.started <- struct{}{}
+	}
+	<-b.release
+	return b.addrs, nil
+}
+
+func (b *blockingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if b.started != nil {
+		b.started <- struct{}{}
+	}
+	<-b.release
+	return b.addrs, nil
+}
+
+// ctxResolver is a DNSResolver blocking lookups until their context is done
+// and reporting the context error on errs.
+type ctxResolver struct {
+	errs chan error
+}
+
+func (c *ctxResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	<-ctx.Done()
+	c.errs <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func (c *ctxResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return c.LookupHost(ctx, addr)
+}
+
+// cancelOnceResolver fails its first lookup with a DNS error once the context
+// is done, like net.Resolver does, then answers normally.
+type cancelOnceResolver struct {
+	fakeResolver
+	cancelled bool
+	// started is closed when the first lookup starts.
+	started chan struct{}
+}
+
+func (c *cancelOnceResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if !c.cancelled {
+		c.cancelled = true
+		close(c.started)
+		<-ctx.Done()
+		return nil, &net.DNSError{Err: "operation was canceled", Name: host}
+	}
+	return c.fakeResolver.LookupHost(ctx, host)
+}
+
+// fakeClock is a manually advanced clock.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
 func TestResolver_LookupHost(t *testing.T) {
 	r := NewDNSResolver(128)
 	var cacheMiss bool
@@ -38,6 +257,29 @@ func TestResolver_LookupHost(t *testing.T) {
 	}
 }
 
+func TestResolver_ZeroValue(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"10.0.0.1"}}}
+	r := &Resolver{Resolver: f}
+	for i := 0; i < 2; i++ {
+		addrs, err := r.LookupHost(context.Background(), "example.com")
+		if err != nil || !reflect.DeepEqual(addrs, []string{"10.0.0.1"}) {
+			t.Errorf("got (%v, %v), want [10.0.0.1]", addrs, err)
+		}
+	}
+	if got := f.callCount(); got != 1 {
+		t.Errorf("got %d upstream calls, want 1", got)
+	}
+	if got := r.Len(); got != 1 {
+		t.Errorf("got len %d, want 1", got)
+	}
+
+	var zero Resolver
+	if zero.Len() != 0 || len(zero.Keys()) != 0 || zero.Remove("example.com") {
+		t.Error("got entries in an unused zero-value Resolver")
+	}
+	zero.Clear()
+}
+
 func TestRaceOnDelete(t *testing.T) {
 	r := NewDNSResolver(128)
 	ls := make(chan bool)
@@ -73,3 +315,1707 @@ func TestRaceOnDelete(t *testing.T) {
 	rs <- true
 
 }
+
+func TestResolver_TTL(t *testing.T) {
+	clock := newFakeClock()
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"1.2.3.4"}}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.TTL = time.Minute
+	r.clock = clock
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.LookupHost(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := f.callCount(); got != 1 {
+		t.Fatalf("got %d upstream calls before expiry, want 1", got)
+	}
+
+	clock.Advance(time.Minute)
+	addrs, err := r.LookupHost(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "1.2.3.4" {
+		t.Errorf("got %v, want [1.2.3.4]", addrs)
+	}
+	if got := f.callCount(); got != 2 {
+		t.Errorf("got %d upstream calls after expiry, want 2", got)
+	}
+}
+
+func TestResolver_TTLDisabled(t *testing.T) {
+	clock := newFakeClock()
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"1.2.3.4"}}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.clock = clock
+
+	r.LookupHost(context.Background(), "example.com")
+	clock.Advance(24 * time.Hour)
+	r.LookupHost(context.Background(), "example.com")
+	if got := f.callCount(); got != 1 {
+		t.Errorf("got %d upstream calls, want 1", got)
+	}
+}
+
+func TestResolver_NegativeTTL(t *testing.T) {
+	clock := newFakeClock()
+	f := &fakeResolver{
+		hosts: map[string][]string{"example.com": {"1.2.3.4"}},
+		err:   errLookup,
+	}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.TTL = time.Hour
+	r.NegativeTTL = time.Second
+	r.clock = clock
+
+	if _, err := r.LookupHost(context.Background(), "example.com"); err == nil {
+		t.Fatal("got nil error, want lookup failure")
+	}
+	if _, err := r.LookupHost(context.Background(), "example.com"); err == nil {
+		t.Fatal("got nil error, want cached lookup failure")
+	}
+	if got := f.callCount(); got != 1 {
+		t.Fatalf("got %d upstream calls before negative expiry, want 1", got)
+	}
+
+	f.setErr(nil)
+	clock.Advance(time.Second)
+	addrs, err := r.LookupHost(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "1.2.3.4" {
+		t.Errorf("got %v, want [1.2.3.4]", addrs)
+	}
+
+	// The successful entry is held for TTL, not NegativeTTL.
+	clock.Advance(time.Minute)
+	r.LookupHost(context.Background(), "example.com")
+	if got := f.callCount(); got != 2 {
+		t.Errorf("got %d upstream calls, want 2", got)
+	}
+}
+
+func TestResolver_Stats(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{
+		"a.com": {"1.1.1.1"},
+		"b.com": {"2.2.2.2"},
+		"c.com": {"3.3.3.3"},
+	}}
+	r := NewDNSResolver(2)
+	r.Resolver = f
+
+	ctx := context.Background()
+	r.LookupHost(ctx, "a.com") // miss
+	r.LookupHost(ctx, "a.com") // hit
+	r.LookupHost(ctx, "b.com") // miss
+	r.LookupHost(ctx, "b.com") // hit
+	r.LookupHost(ctx, "a.com") // hit
+	r.LookupHost(ctx, "c.com") // miss, evicts b.com
+
+	want := Stats{Hits: 3, Misses: 3, Evictions: 1}
+	if got := r.Stats(); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestResolver_LookupIP(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{
+		"example.com": {"1.2.3.4", "2001:db8::1", "5.6.7.8", "2001:db8::2"},
+	}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+
+	tests := []struct {
+		network string
+		want    []string
+	}{
+		{"ip", []string{"1.2.3.4", "2001:db8::1", "5.6.7.8", "2001:db8::2"}},
+		{"ip4", []string{"1.2.3.4", "5.6.7.8"}},
+		{"ip6", []string{"2001:db8::1", "2001:db8::2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			ips, err := r.LookupIP(context.Background(), tt.network, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ips) != len(tt.want) {
+				t.Fatalf("got %v, want %v", ips, tt.want)
+			}
+			for i, ip := range ips {
+				if !ip.Equal(net.ParseIP(tt.want[i])) {
+					t.Errorf("got %v at %d, want %v", ip, i, tt.want[i])
+				}
+			}
+		})
+	}
+	if got := f.callCount(); got != 1 {
+		t.Errorf("got %d upstream calls, want 1", got)
+	}
+
+	if _, err := r.LookupIP(context.Background(), "tcp", "example.com"); err == nil {
+		t.Error("got nil error for invalid network")
+	}
+}
+
+func TestResolver_LookupIPAddr(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{
+		"example.com": {"10.0.0.1", "fe80::1%eth0", "bogus", "10.0.0.2%eth0"},
+		"bogus.com":   {"bogus"},
+	}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+
+	want := []net.IPAddr{
+		{IP: net.ParseIP("10.0.0.1")},
+		{IP: net.ParseIP("fe80::1"), Zone: "eth0"},
+	}
+	for i := 0; i < 2; i++ {
+		got, err := r.LookupIPAddr(context.Background(), "example.com")
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("got (%v, %v), want %v", got, err, want)
+		}
+	}
+	if got := f.callCount(); got != 1 {
+		t.Errorf("got %d upstream calls, want 1", got)
+	}
+	if _, err := r.LookupIPAddr(context.Background(), "bogus.com"); err == nil {
+		t.Error("got no error without valid addresses")
+	}
+}
+
+func TestResolver_IndependentLookupGroups(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	newResolver := func(addr string) *Resolver {
+		r := NewDNSResolver(128)
+		r.Resolver = &blockingResolver{addrs: []string{addr}, release: release, started: started}
+		return r
+	}
+	r1 := newResolver("1.1.1.1")
+	r2 := newResolver("2.2.2.2")
+
+	var wg sync.WaitGroup
+	results := make([][]string, 2)
+	for i, r := range []*Resolver{r1, r2} {
+		wg.Add(1)
+		go func(i int, r *Resolver) {
+			defer wg.Done()
+			results[i], _ = r.LookupHost(context.Background(), "example.com")
+		}(i, r)
+	}
+	// Both lookups must be upstream at once, so neither shares the other.
+	<-started
+	<-started
+	close(release)
+	wg.Wait()
+
+	if len(results[0]) != 1 || results[0][0] != "1.1.1.1" {
+		t.Errorf("first resolver got %v, want [1.1.1.1]", results[0])
+	}
+	if len(results[1]) != 1 || results[1][0] != "2.2.2.2" {
+		t.Errorf("second resolver got %v, want [2.2.2.2]", results[1])
+	}
+}
+
+func TestResolver_DisableSingleflight(t *testing.T) {
+	const n = 5
+	for _, tt := range []struct {
+		disable bool
+		want    int
+	}{
+		{false, 1},
+		{true, n},
+	} {
+		t.Run(fmt.Sprint(tt.disable), func(t *testing.T) {
+			f := &fakeResolver{
+				hosts: map[string][]string{"example.com": {"10.0.0.1"}},
+				delay: 100 * time.Millisecond,
+			}
+			r := NewDNSResolver(128)
+			r.Resolver = f
+			r.DisableSingleflight = tt.disable
+
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := r.LookupHost(context.Background(), "example.com"); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+			if got := f.callCount(); got != tt.want {
+				t.Errorf("got %d upstream calls, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolver_KeyKindsDoNotCollide(t *testing.T) {
+	f := &fakeResolver{
+		hosts: map[string][]string{"r1.2.3.4": {"5.6.7.8"}},
+		addrs: map[string][]string{"1.2.3.4": {"reverse.example.com."}},
+	}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+
+	names, err := r.LookupAddr(context.Background(), "1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "reverse.example.com." {
+		t.Fatalf("got %v, want [reverse.example.com.]", names)
+	}
+	addrs, err := r.LookupHost(context.Background(), "r1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "5.6.7.8" {
+		t.Errorf("got %v, want [5.6.7.8]", addrs)
+	}
+	if got := f.callCount(); got != 2 {
+		t.Errorf("got %d upstream calls, want 2", got)
+	}
+}
+
+func TestResolver_CallerContextCancelsUpstream(t *testing.T) {
+	c := &ctxResolver{errs: make(chan error, 1)}
+	r := NewDNSResolver(128)
+	r.Resolver = c
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := r.LookupHost(ctx, "example.com"); err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	select {
+	case err := <-c.errs:
+		if err != context.Canceled {
+			t.Errorf("upstream got %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("upstream lookup was not cancelled")
+	}
+	if r.Len() != 0 {
+		t.Error("cancelled lookup was cached")
+	}
+}
+
+func TestResolver_LookupCNAME(t *testing.T) {
+	f := &fakeResolver{cnames: map[string]string{"www.example.com": "example.com."}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	var misses int
+	r.OnCacheMiss = func() { misses++ }
+
+	for i := 0; i < 2; i++ {
+		cname, err := r.LookupCNAME(context.Background(), "www.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cname != "example.com." {
+			t.Errorf("got %q, want example.com.", cname)
+		}
+	}
+	if misses != 1 || f.callCount() != 1 {
+		t.Errorf("got %d misses and %d upstream calls, want 1 and 1", misses, f.callCount())
+	}
+
+	f.setErr(errLookup)
+	for i := 0; i < 2; i++ {
+		if _, err := r.LookupCNAME(context.Background(), "fail.example.com"); err == nil {
+			t.Error("got nil error, want lookup failure")
+		}
+	}
+	if f.callCount() != 2 {
+		t.Errorf("got %d upstream calls, want error to be cached", f.callCount())
+	}
+}
+
+func TestResolver_LookupCNAMENotSupported(t *testing.T) {
+	r := NewDNSResolver(128)
+	r.Resolver = &blockingResolver{}
+	if _, err := r.LookupCNAME(context.Background(), "example.com"); err != ErrNotSupported {
+		t.Errorf("got %v, want ErrNotSupported", err)
+	}
+	if r.Len() != 0 {
+		t.Error("unsupported lookup was cached")
+	}
+}
+
+func TestResolver_Clear(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{
+		"a.com": {"1.1.1.1"},
+		"b.com": {"2.2.2.2"},
+	}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	var misses int
+	r.OnCacheMiss = func() { misses++ }
+
+	r.LookupHost(context.Background(), "a.com")
+	r.LookupHost(context.Background(), "b.com")
+	r.Clear()
+	if r.Len() != 0 {
+		t.Errorf("got %d entries after Clear, want 0", r.Len())
+	}
+	r.LookupHost(context.Background(), "a.com")
+	r.LookupHost(context.Background(), "b.com")
+	if misses != 4 {
+		t.Errorf("got %d misses, want 4", misses)
+	}
+	if got, want := r.Stats(), (Stats{Misses: 4}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestResolver_Remove(t *testing.T) {
+	f := &fakeResolver{
+		hosts: map[string][]string{"a.com": {"1.1.1.1"}, "b.com": {"2.2.2.2"}},
+		addrs: map[string][]string{"1.1.1.1": {"a.com."}},
+	}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	ctx := context.Background()
+	r.LookupHost(ctx, "a.com")
+	r.LookupHost(ctx, "b.com")
+	r.LookupAddr(ctx, "1.1.1.1")
+
+	if !r.Remove("a.com") {
+		t.Error("Remove(a.com) = false, want true")
+	}
+	if r.Remove("a.com") {
+		t.Error("second Remove(a.com) = true, want false")
+	}
+	if r.Len() != 2 {
+		t.Errorf("got %d entries, want 2", r.Len())
+	}
+	r.LookupHost(ctx, "b.com")
+	if f.callCount() != 3 {
+		t.Errorf("got %d upstream calls, want b.com to stay cached", f.callCount())
+	}
+	r.LookupHost(ctx, "a.com")
+	if f.callCount() != 4 {
+		t.Errorf("got %d upstream calls, want a.com to be looked up again", f.callCount())
+	}
+
+	if !r.RemoveAddr("1.1.1.1") {
+		t.Error("RemoveAddr(1.1.1.1) = false, want true")
+	}
+	if r.RemoveAddr("1.1.1.1") {
+		t.Error("second RemoveAddr(1.1.1.1) = true, want false")
+	}
+}
+
+func TestResolver_Set(t *testing.T) {
+	clock := newFakeClock()
+	f := &fakeResolver{
+		hosts: map[string][]string{"a.com": {"2.2.2.2"}},
+		addrs: map[string][]string{"1.1.1.1": {"b.com."}},
+	}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.TTL = time.Minute
+	r.clock = clock
+	ctx := context.Background()
+
+	addrs := []string{"1.1.1.1"}
+	r.Set("a.com", addrs)
+	r.SetAddr("1.1.1.1", []string{"a.com."})
+	addrs[0] = "0.0.0.0"
+	if got, err := r.LookupHost(ctx, "a.com"); err != nil || !reflect.DeepEqual(got, []string{"1.1.1.1"}) {
+		t.Errorf("LookupHost: got (%v, %v), want [1.1.1.1]", got, err)
+	}
+	if got, err := r.LookupAddr(ctx, "1.1.1.1"); err != nil || !reflect.DeepEqual(got, []string{"a.com."}) {
+		t.Errorf("LookupAddr: got (%v, %v), want [a.com.]", got, err)
+	}
+	if got := f.callCount(); got != 0 {
+		t.Errorf("got %d upstream calls, want 0", got)
+	}
+
+	clock.Advance(time.Minute)
+	if got, _ := r.LookupHost(ctx, "a.com"); !reflect.DeepEqual(got, []string{"2.2.2.2"}) {
+		t.Errorf("got %v after TTL, want the upstream result [2.2.2.2]", got)
+	}
+}
+
+func TestResolver_RemoveMatching(t *testing.T) {
+	f := &fakeResolver{
+		hosts: map[string][]string{
+			"a.internal.example.com": {"10.0.0.1"},
+			"b.internal.example.com": {"10.0.0.2"},
+			"internal.example.com":   {"10.0.0.3"},
+			"example.com":            {"93.184.216.34"},
+		},
+		addrs: map[string][]string{"10.0.0.1": {"a.internal.example.com."}},
+	}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	ctx := context.Background()
+	for host := range f.hosts {
+		r.LookupHost(ctx, host)
+	}
+	r.LookupAddr(ctx, "10.0.0.1")
+
+	n := r.RemoveMatching(func(kind byte, subject string) bool {
+		return kind == KindHost && strings.HasSuffix(subject, ".internal.example.com")
+	})
+	if n != 2 {
+		t.Errorf("removed %d entries, want 2", n)
+	}
+	want := []Key{
+		{Kind: KindHost, Subject: "example.com"},
+		{Kind: KindHost, Subject: "internal.example.com"},
+		{Kind: KindAddr, Subject: "10.0.0.1"},
+	}
+	got := r.Keys()
+	sort.Slice(got, func(i, j int) bool {
+		if got[i].Kind != got[j].Kind {
+			return got[i].Kind < got[j].Kind
+		}
+		return got[i].Subject < got[j].Subject
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got keys %v, want %v", got, want)
+	}
+	if n := r.RemoveMatching(func(byte, string) bool { return false }); n != 0 {
+		t.Errorf("removed %d entries, want 0", n)
+	}
+}
+
+func TestResolver_LenAndKeys(t *testing.T) {
+	f := &fakeResolver{
+		hosts: map[string][]string{"a.com": {"1.1.1.1"}},
+		addrs: map[string][]string{"1.1.1.1": {"a.com."}},
+	}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	ctx := context.Background()
+
+	if r.Len() != 0 {
+		t.Errorf("got len %d, want 0", r.Len())
+	}
+	r.LookupHost(ctx, "a.com")
+	r.LookupAddr(ctx, "1.1.1.1")
+	if r.Len() != 2 {
+		t.Errorf("got len %d, want 2", r.Len())
+	}
+	want := []Key{{Kind: KindHost, Subject: "a.com"}, {Kind: KindAddr, Subject: "1.1.1.1"}}
+	if got := r.Keys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got keys %v, want %v", got, want)
+	}
+	r.Remove("a.com")
+	if r.Len() != 1 {
+		t.Errorf("got len %d after Remove, want 1", r.Len())
+	}
+}
+
+func TestResolver_EntryInfo(t *testing.T) {
+	clock := newFakeClock()
+	f := &fakeResolver{hosts: map[string][]string{"a.com": {"1.1.1.1"}}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.clock = clock
+	key := Key{Kind: KindHost, Subject: "a.com"}
+
+	if _, _, ok := r.EntryInfo(key); ok {
+		t.Error("got info for an entry not cached yet")
+	}
+	r.LookupHost(context.Background(), "a.com")
+	addrs, storedAt, ok := r.EntryInfo(key)
+	if !ok || !reflect.DeepEqual(addrs, []string{"1.1.1.1"}) || !storedAt.Equal(clock.Now()) {
+		t.Errorf("got (%v, %v, %v), want ([1.1.1.1], %v, true)", addrs, storedAt, ok, clock.Now())
+	}
+
+	clock.Advance(time.Minute)
+	f.setHosts(map[string][]string{"a.com": {"2.2.2.2"}})
+	r.Refresh()
+	addrs, refreshedAt, ok := r.EntryInfo(key)
+	if !ok || !reflect.DeepEqual(addrs, []string{"2.2.2.2"}) {
+		t.Errorf("got (%v, %v) after refresh, want [2.2.2.2]", addrs, ok)
+	}
+	if got := refreshedAt.Sub(storedAt); got != time.Minute {
+		t.Errorf("stored time advanced by %v after refresh, want %v", got, time.Minute)
+	}
+}
+
+func TestResolver_ServeStale(t *testing.T) {
+	for _, serveStale := range []bool{false, true} {
+		t.Run(fmt.Sprint(serveStale), func(t *testing.T) {
+			clock := newFakeClock()
+			f := &fakeResolver{hosts: map[string][]string{"example.com": {"1.2.3.4"}}}
+			r := NewDNSResolver(128)
+			r.Resolver = f
+			r.TTL = time.Minute
+			r.TransientErrorTTL = time.Second
+			r.ServeStale = serveStale
+			r.clock = clock
+
+			if _, err := r.LookupHost(context.Background(), "example.com"); err != nil {
+				t.Fatal(err)
+			}
+			f.setErr(errors.New("upstream unreachable"))
+			clock.Advance(time.Minute)
+
+			for i := 0; i < 2; i++ {
+				addrs, err := r.LookupHost(context.Background(), "example.com")
+				if !serveStale {
+					if err == nil {
+						t.Error("got nil error, want upstream failure")
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(addrs) != 1 || addrs[0] != "1.2.3.4" {
+					t.Errorf("got %v, want stale [1.2.3.4]", addrs)
+				}
+			}
+			if f.callCount() != 2 {
+				t.Errorf("got %d upstream calls, want failure to be cached", f.callCount())
+			}
+		})
+	}
+}
+
+func TestResolver_LookupHostStale(t *testing.T) {
+	for _, serveStale := range []bool{false, true} {
+		t.Run(fmt.Sprint(serveStale), func(t *testing.T) {
+			clock := newFakeClock()
+			f := &fakeResolver{hosts: map[string][]string{"example.com": {"1.2.3.4"}}}
+			r := NewDNSResolver(128)
+			r.Resolver = f
+			r.TTL = time.Minute
+			r.ServeStale = serveStale
+			r.clock = clock
+			ctx := context.Background()
+
+			addrs, stale, err := r.LookupHostStale(ctx, "example.com")
+			if err != nil || stale || !reflect.DeepEqual(addrs, []string{"1.2.3.4"}) {
+				t.Errorf("got (%v, %v, %v), want fresh [1.2.3.4]", addrs, stale, err)
+			}
+			f.setErr(errors.New("upstream unreachable"))
+			clock.Advance(time.Minute)
+			for i := 0; i < 2; i++ {
+				addrs, stale, err = r.LookupHostStale(ctx, "example.com")
+				if err != nil || !stale || !reflect.DeepEqual(addrs, []string{"1.2.3.4"}) {
+					t.Errorf("got (%v, %v, %v), want stale [1.2.3.4]", addrs, stale, err)
+				}
+			}
+
+			f.setErr(nil)
+			f.setHosts(map[string][]string{"example.com": {"5.6.7.8"}})
+			addrs, stale, err = r.LookupHostStale(ctx, "example.com")
+			if err != nil || stale || !reflect.DeepEqual(addrs, []string{"5.6.7.8"}) {
+				t.Errorf("got (%v, %v, %v), want fresh [5.6.7.8]", addrs, stale, err)
+			}
+		})
+	}
+}
+
+func TestResolver_ServeStaleTimeout(t *testing.T) {
+	// The upstream hangs until its context is done, so only Timeout ends
+	// the lookups, with errors wrapping context.DeadlineExceeded.
+	hang := func(ctx context.Context, host string) ([]string, error) {
+		<-ctx.Done()
+		return nil, &net.DNSError{Err: fmt.Errorf("lookup %s: %w", host, ctx.Err()).Error(), Name: host, IsTimeout: true}
+	}
+	wrapped := func(ctx context.Context, host string) ([]string, error) {
+		<-ctx.Done()
+		return nil, fmt.Errorf("lookup %s: %w", host, ctx.Err())
+	}
+	bare := func(ctx context.Context, host string) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	for name, fn := range map[string]func(context.Context, string) ([]string, error){
+		"timeout": hang, "wrapped": wrapped, "bare": bare,
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := NewDNSResolver(128)
+			r.Resolver = FuncResolver{HostFunc: fn}
+			r.Timeout = 20 * time.Millisecond
+			r.ServeStale = true
+			r.Set("example.com", []string{"1.2.3.4"})
+			r.Expire()
+
+			addrs, err := r.LookupHost(context.Background(), "example.com")
+			if err != nil || !reflect.DeepEqual(addrs, []string{"1.2.3.4"}) {
+				t.Errorf("LookupHost: got (%v, %v), want stale [1.2.3.4]", addrs, err)
+			}
+
+			r.ServeStale = false
+			r.Expire()
+			addrs, stale, err := r.LookupHostStale(context.Background(), "example.com")
+			if err != nil || !stale || !reflect.DeepEqual(addrs, []string{"1.2.3.4"}) {
+				t.Errorf("LookupHostStale: got (%v, %v, %v), want stale [1.2.3.4]", addrs, stale, err)
+			}
+
+			// A caller giving up still gets its own context error.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+			defer cancel()
+			r.Expire()
+			if _, _, err := r.LookupHostStale(ctx, "example.com"); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("LookupHostStale with a cancelled context: got %v, want context.DeadlineExceeded", err)
+			}
+		})
+	}
+}
+
+func TestResolver_OnCacheHit(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{"a.com": {"1.1.1.1"}, "b.com": {"2.2.2.2"}}}
+	var hits, misses int
+	r, err := New(
+		WithResolver(f),
+		WithOnCacheHit(func() { hits++ }),
+		WithOnCacheMiss(func() { misses++ }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, host := range []string{"a.com", "a.com", "b.com", "a.com", "b.com"} {
+		r.LookupHost(ctx, host)
+	}
+	if hits != 3 || misses != 2 {
+		t.Errorf("got %d hits and %d misses, want 3 and 2", hits, misses)
+	}
+}
+
+func TestResolver_ShuffleAddresses(t *testing.T) {
+	want := []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4", "5.5.5.5"}
+	f := &fakeResolver{hosts: map[string][]string{"example.com": want}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.ShuffleAddresses = true
+
+	orders := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		addrs, err := r.LookupHost(context.Background(), "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sorted := append([]string(nil), addrs...)
+		sort.Strings(sorted)
+		if !reflect.DeepEqual(sorted, want) {
+			t.Fatalf("got %v, want a permutation of %v", addrs, want)
+		}
+		orders[fmt.Sprint(addrs)] = true
+	}
+	if len(orders) < 2 {
+		t.Error("got the same order on every call")
+	}
+	if !reflect.DeepEqual(f.hosts["example.com"], want) {
+		t.Errorf("cached slice was reordered: %v", f.hosts["example.com"])
+	}
+}
+
+func TestResolver_Rand(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{
+		"example.com": {"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4", "5.5.5.5"},
+	}}
+	orders := func() []string {
+		r := NewDNSResolver(128)
+		r.Resolver = f
+		r.ShuffleAddresses = true
+		r.RefreshJitter = time.Second
+		r.Rand = rand.New(rand.NewSource(42))
+		var orders []string
+		for i := 0; i < 10; i++ {
+			addrs, err := r.LookupHost(context.Background(), "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			orders = append(orders, fmt.Sprint(addrs, r.jitter(time.Minute)))
+		}
+		return orders
+	}
+	if a, b := orders(), orders(); !reflect.DeepEqual(a, b) {
+		t.Errorf("got different orders with the same seed:\n%v\n%v", a, b)
+	}
+}
+
+func TestResolver_MinMaxTTL(t *testing.T) {
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		wantAlive time.Duration
+		wantDead  time.Duration
+	}{
+		{"tiny TTL held for MinTTL", time.Millisecond, 9 * time.Second, 10 * time.Second},
+		{"huge TTL capped at MaxTTL", 24 * time.Hour, 59 * time.Minute, time.Hour},
+		{"no TTL capped at MaxTTL", 0, 59 * time.Minute, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			f := &fakeResolver{hosts: map[string][]string{"example.com": {"1.2.3.4"}}}
+			r := NewDNSResolver(128)
+			r.Resolver = f
+			r.TTL = tt.ttl
+			r.MinTTL = 10 * time.Second
+			r.MaxTTL = time.Hour
+			r.clock = clock
+
+			r.LookupHost(context.Background(), "example.com")
+			clock.Advance(tt.wantAlive)
+			r.LookupHost(context.Background(), "example.com")
+			if f.callCount() != 1 {
+				t.Errorf("entry expired before %v", tt.wantAlive)
+			}
+			clock.Advance(tt.wantDead - tt.wantAlive)
+			r.LookupHost(context.Background(), "example.com")
+			if f.callCount() != 2 {
+				t.Errorf("entry still cached after %v", tt.wantDead)
+			}
+		})
+	}
+}
+
+func TestResolver_PerCallTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeout     time.Duration
+		ctxDeadline time.Duration
+	}{
+		{"context deadline shorter than Timeout", time.Minute, 20 * time.Millisecond},
+		{"Timeout shorter than context deadline", 20 * time.Millisecond, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ctxResolver{errs: make(chan error, 1)}
+			r := NewDNSResolver(128)
+			r.Resolver = c
+			r.Timeout = tt.timeout
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.ctxDeadline)
+			defer cancel()
+			start := time.Now()
+			if _, err := r.LookupHost(ctx, "example.com"); err != context.DeadlineExceeded {
+				t.Errorf("got %v, want context.DeadlineExceeded", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("lookup took %v, want about 20ms", elapsed)
+			}
+			if err := <-c.errs; err != context.DeadlineExceeded {
+				t.Errorf("upstream got %v, want context.DeadlineExceeded", err)
+			}
+		})
+	}
+}
+
+func TestResolver_TimeoutBoundsWait(t *testing.T) {
+	// The upstream ignores its context, so only Timeout bounds the wait.
+	b := &blockingResolver{addrs: []string{"1.2.3.4"}, release: make(chan struct{})}
+	r := NewDNSResolver(128)
+	r.Resolver = b
+	r.Timeout = 20 * time.Millisecond
+
+	start := time.Now()
+	if _, err := r.LookupHost(context.Background(), "example.com"); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("lookup took %v, want about %v", elapsed, r.Timeout)
+	}
+
+	// The late answer is still cached once the upstream returns.
+	close(b.release)
+	deadline := time.Now().Add(time.Second)
+	for r.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("late answer was not cached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if addrs, hit, err := r.LookupHostCached(context.Background(), "example.com"); err != nil || !hit || len(addrs) != 1 {
+		t.Errorf("got (%v, %v, %v), want the cached late answer", addrs, hit, err)
+	}
+
+	// Concurrent callers sharing a lookup that runs out of Timeout do not
+	// start lookups of their own, each waiting no longer than Timeout.
+	r = NewDNSResolver(128)
+	r.Resolver = FuncResolver{HostFunc: func(ctx context.Context, host string) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}}
+	r.Timeout = 100 * time.Millisecond
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			if _, err := r.LookupHost(context.Background(), "hang.example.com"); err == nil {
+				t.Error("got nil error from a hanging upstream")
+			}
+			if elapsed := time.Since(start); elapsed > 3*r.Timeout/2 {
+				t.Errorf("concurrent lookup took %v, want about %v", elapsed, r.Timeout)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestResolver_CachedDNSError(t *testing.T) {
+	for _, upstreamErr := range []error{errLookup, fmt.Errorf("upstream: %w", errLookup)} {
+		f := &fakeResolver{err: upstreamErr}
+		r := NewDNSResolver(128)
+		r.Resolver = f
+		for i := 0; i < 2; i++ {
+			_, err := r.LookupHost(context.Background(), "example.com")
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+				t.Errorf("lookup %d: got %v, want a not found *net.DNSError", i, err)
+			}
+		}
+		if got := f.callCount(); got != 1 {
+			t.Errorf("got %d upstream calls, want 1 as the error is cached", got)
+		}
+	}
+}
+
+func TestResolver_CachedErrorsLight(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		class error
+	}{
+		{"not found", fmt.Errorf("large context %s: %w", strings.Repeat("x", 1<<16), errLookup), ErrNotFound},
+		{"timeout", &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, ErrTimeout},
+		{"server failure", &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}, ErrTemporary},
+		{"other", errors.New("upstream unreachable"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeResolver{err: tt.err}
+			r := NewDNSResolver(128)
+			r.Resolver = f
+			r.TransientErrorTTL = time.Minute
+
+			if _, err := r.LookupHost(context.Background(), "example.com"); err != tt.err {
+				t.Errorf("got %v from the upstream lookup, want the original error", err)
+			}
+			_, err := r.LookupHost(context.Background(), "example.com")
+			if _, ok := err.(*cachedError); !ok {
+				t.Fatalf("got cached error of type %T, want a lightweight error", err)
+			}
+			if err.Error() != tt.err.Error() {
+				t.Errorf("got message %q, want %q", err, tt.err)
+			}
+			for _, class := range []error{ErrNotFound, ErrTimeout, ErrTemporary} {
+				if got, want := errors.Is(err, class), class == tt.class; got != want {
+					t.Errorf("errors.Is(err, %v) = %v, want %v", class, got, want)
+				}
+			}
+			var dnsErr *net.DNSError
+			if got, want := errors.As(err, &dnsErr), tt.class != nil; got != want {
+				t.Errorf("errors.As(err, *net.DNSError) = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestResolver_ErrorClasses(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantCalls []int
+	}{
+		// Not found errors are cached for NegativeTTL.
+		{"not found", errLookup, []int{1, 1, 2}},
+		// Transient errors are cached for TransientErrorTTL.
+		{"timeout", &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, []int{1, 2, 3}},
+		{"server failure", &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}, []int{1, 2, 3}},
+		{"other", errors.New("upstream unreachable"), []int{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			f := &fakeResolver{err: tt.err}
+			r := NewDNSResolver(128)
+			r.Resolver = f
+			r.NegativeTTL = time.Minute
+			r.TransientErrorTTL = time.Second
+			r.clock = clock
+
+			for i, advance := range []time.Duration{0, 2 * time.Second, time.Minute} {
+				clock.Advance(advance)
+				// Cached errors keep the message of the original error.
+				if _, err := r.LookupHost(context.Background(), "example.com"); err == nil || err.Error() != tt.err.Error() {
+					t.Errorf("got %v, want %v", err, tt.err)
+				}
+				if got := f.callCount(); got != tt.wantCalls[i] {
+					t.Errorf("lookup %d: got %d upstream calls, want %d", i, got, tt.wantCalls[i])
+				}
+			}
+		})
+	}
+}
+
+func TestResolver_TransientErrorsNotCachedByDefault(t *testing.T) {
+	f := &fakeResolver{err: &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.LookupHost(context.Background(), "example.com")
+	r.LookupHost(context.Background(), "example.com")
+	if f.callCount() != 2 || r.Len() != 0 {
+		t.Errorf("got %d upstream calls and %d entries, want 2 and 0", f.callCount(), r.Len())
+	}
+}
+
+func TestResolver_StaleWhileRevalidate(t *testing.T) {
+	clock := newFakeClock()
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"1.2.3.4"}}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.TTL = time.Minute
+	r.StaleWhileRevalidate = true
+	r.clock = clock
+	r.LookupHost(context.Background(), "example.com")
+
+	f.delay = 50 * time.Millisecond
+	f.setHosts(map[string][]string{"example.com": {"5.6.7.8"}})
+	clock.Advance(time.Minute)
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		addrs, err := r.LookupHost(context.Background(), "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > 25*time.Millisecond {
+			t.Errorf("stale lookup took %v, want it to return immediately", elapsed)
+		}
+		if len(addrs) != 1 || addrs[0] != "1.2.3.4" {
+			t.Errorf("got %v, want stale [1.2.3.4]", addrs)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		addrs, _ := r.LookupHost(context.Background(), "example.com")
+		if len(addrs) == 1 && addrs[0] == "5.6.7.8" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("entry was not revalidated")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := f.callCount(); got != 2 {
+		t.Errorf("got %d upstream calls, want a single revalidation", got)
+	}
+}
+
+func TestResolver_NoCacheEmpty(t *testing.T) {
+	for _, noCacheEmpty := range []bool{false, true} {
+		t.Run(fmt.Sprint(noCacheEmpty), func(t *testing.T) {
+			f := &fakeResolver{hosts: map[string][]string{"example.com": {}}}
+			r := NewDNSResolver(128)
+			r.Resolver = f
+			r.NoCacheEmpty = noCacheEmpty
+
+			for i := 0; i < 2; i++ {
+				addrs, err := r.LookupHost(context.Background(), "example.com")
+				if err != nil || len(addrs) != 0 {
+					t.Errorf("got (%v, %v), want an empty result", addrs, err)
+				}
+			}
+			want := 1
+			if noCacheEmpty {
+				want = 2
+			}
+			if got := f.callCount(); got != want {
+				t.Errorf("got %d upstream calls, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestResolver_DedupeAddresses(t *testing.T) {
+	upstream := []string{"1.2.3.4", "1.2.3.4", "5.6.7.8"}
+	for _, tt := range []struct {
+		dedupe bool
+		want   []string
+	}{
+		{false, upstream},
+		{true, []string{"1.2.3.4", "5.6.7.8"}},
+	} {
+		t.Run(fmt.Sprint(tt.dedupe), func(t *testing.T) {
+			f := &fakeResolver{hosts: map[string][]string{"example.com": upstream}}
+			r := NewDNSResolver(128)
+			r.Resolver = f
+			r.DedupeAddresses = tt.dedupe
+
+			for i := 0; i < 2; i++ {
+				got, err := r.LookupHost(context.Background(), "example.com")
+				if err != nil || !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("LookupHost: got (%v, %v), want %v", got, err, tt.want)
+				}
+			}
+			ips, err := r.LookupIP(context.Background(), "ip", "example.com")
+			if err != nil || len(ips) != len(tt.want) {
+				t.Errorf("LookupIP: got (%v, %v), want %d addresses", ips, err, len(tt.want))
+			}
+			if got := f.callCount(); got != 1 {
+				t.Errorf("got %d upstream calls, want 1", got)
+			}
+			if !reflect.DeepEqual(f.hosts["example.com"], []string{"1.2.3.4", "1.2.3.4", "5.6.7.8"}) {
+				t.Errorf("upstream answer was modified: %v", f.hosts["example.com"])
+			}
+		})
+	}
+}
+
+func TestResolver_NormalizeNames(t *testing.T) {
+	names := []string{"Host.Example.Com.", "host.example.com."}
+	for _, tt := range []struct {
+		normalize bool
+		want      []string
+	}{
+		{false, names},
+		{true, []string{"host.example.com"}},
+	} {
+		t.Run(fmt.Sprint(tt.normalize), func(t *testing.T) {
+			f := &fakeResolver{addrs: map[string][]string{"10.0.0.1": names}}
+			r := NewDNSResolver(128)
+			r.Resolver = f
+			r.NormalizeNames = tt.normalize
+
+			for i := 0; i < 2; i++ {
+				got, err := r.LookupAddr(context.Background(), "10.0.0.1")
+				if err != nil || !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("got (%v, %v), want %v", got, err, tt.want)
+				}
+			}
+			if got := f.callCount(); got != 1 {
+				t.Errorf("got %d upstream calls, want 1", got)
+			}
+		})
+	}
+}
+
+func TestResolver_Validate(t *testing.T) {
+	errPrivate := errors.New("private address")
+	f := &fakeResolver{hosts: map[string][]string{
+		"example.com": {"93.184.216.34"},
+		"evil.com":    {"127.0.0.1"},
+	}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.Validate = func(host string, addrs []string) error {
+		for _, addr := range addrs {
+			if ip := net.ParseIP(addr); ip != nil && ip.IsLoopback() {
+				return errPrivate
+			}
+		}
+		return nil
+	}
+
+	if addrs, err := r.LookupHost(context.Background(), "example.com"); err != nil || len(addrs) != 1 {
+		t.Errorf("got (%v, %v), want a valid result", addrs, err)
+	}
+	for i := 0; i < 2; i++ {
+		addrs, err := r.LookupHost(context.Background(), "evil.com")
+		if err != errPrivate || addrs != nil {
+			t.Errorf("got (%v, %v), want %v", addrs, err, errPrivate)
+		}
+	}
+	if _, err := r.LookupIP(context.Background(), "ip", "evil.com"); err != errPrivate {
+		t.Errorf("LookupIP: got %v, want %v", err, errPrivate)
+	}
+	if got := f.callCount(); got != 4 {
+		t.Errorf("got %d upstream calls, want 4 as rejected results are not cached", got)
+	}
+}
+
+func TestResolver_NoCache(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{
+		"failover.example.com": {"10.0.0.1"},
+		"stable.example.com":   {"10.0.0.2"},
+	}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.NoCache = func(host string) bool { return host == "failover.example.com" }
+
+	for i := 0; i < 3; i++ {
+		for host, want := range f.hosts {
+			if got, err := r.LookupHost(context.Background(), host); err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("LookupHost(%q) = (%v, %v), want %v", host, got, err, want)
+			}
+		}
+	}
+	if got := f.callCount(); got != 4 {
+		t.Errorf("got %d upstream calls, want 4: 3 for the uncached host and 1 for the other", got)
+	}
+	if want := []Key{{Kind: KindHost, Subject: "stable.example.com"}}; !reflect.DeepEqual(r.Keys(), want) {
+		t.Errorf("got keys %v, want %v", r.Keys(), want)
+	}
+}
+
+func TestResolver_ReturnsCopies(t *testing.T) {
+	f := &fakeResolver{
+		hosts: map[string][]string{"example.com": {"1.1.1.1", "2.2.2.2"}},
+		addrs: map[string][]string{"1.1.1.1": {"a.example.com.", "b.example.com."}},
+		mxs:   map[string][]*net.MX{"example.com": {{Host: "mx.example.com.", Pref: 10}}},
+	}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				addrs, _ := r.LookupHost(ctx, "example.com")
+				sort.Sort(sort.Reverse(sort.StringSlice(addrs)))
+				addrs[0] = "6.6.6.6"
+				names, _ := r.LookupAddr(ctx, "1.1.1.1")
+				names[0] = "evil.example.com."
+				mxs, _ := r.LookupMX(ctx, "example.com")
+				mxs[0].Host = "evil.example.com."
+			}
+		}()
+	}
+	wg.Wait()
+
+	if addrs, _ := r.LookupHost(ctx, "example.com"); !reflect.DeepEqual(addrs, []string{"1.1.1.1", "2.2.2.2"}) {
+		t.Errorf("got %v, want unmodified addresses", addrs)
+	}
+	if names, _ := r.LookupAddr(ctx, "1.1.1.1"); !reflect.DeepEqual(names, []string{"a.example.com.", "b.example.com."}) {
+		t.Errorf("got %v, want unmodified names", names)
+	}
+	if mxs, _ := r.LookupMX(ctx, "example.com"); mxs[0].Host != "mx.example.com." {
+		t.Errorf("got MX host %q, want unmodified record", mxs[0].Host)
+	}
+}
+
+func TestResolver_LookupCached(t *testing.T) {
+	f := &fakeResolver{
+		hosts: map[string][]string{"example.com": {"1.2.3.4"}},
+		addrs: map[string][]string{"1.2.3.4": {"example.com."}},
+	}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	ctx := context.Background()
+
+	for _, wantHit := range []bool{false, true} {
+		addrs, hit, err := r.LookupHostCached(ctx, "example.com")
+		if err != nil || len(addrs) != 1 {
+			t.Errorf("got (%v, %v), want [1.2.3.4]", addrs, err)
+		}
+		if hit != wantHit {
+			t.Errorf("LookupHostCached: got hit %v, want %v", hit, wantHit)
+		}
+		names, hit, err := r.LookupAddrCached(ctx, "1.2.3.4")
+		if err != nil || len(names) != 1 {
+			t.Errorf("got (%v, %v), want [example.com.]", names, err)
+		}
+		if hit != wantHit {
+			t.Errorf("LookupAddrCached: got hit %v, want %v", hit, wantHit)
+		}
+	}
+}
+
+func TestResolver_CancelledLookupNotCached(t *testing.T) {
+	c := &cancelOnceResolver{
+		fakeResolver: fakeResolver{hosts: map[string][]string{"example.com": {"1.2.3.4"}}},
+		started:      make(chan struct{}),
+	}
+	r := NewDNSResolver(128)
+	r.Resolver = c
+	r.TransientErrorTTL = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-c.started
+		cancel()
+	}()
+	if _, err := r.LookupHost(ctx, "example.com"); err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	// Wait for the upstream call to return its DNS error and be handled.
+	deadline := time.Now().Add(time.Second)
+	for len(r.InFlight()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("upstream lookup did not return")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if r.Len() != 0 {
+		t.Fatal("cancelled lookup was cached")
+	}
+
+	addrs, hit, err := r.LookupHostCached(context.Background(), "example.com")
+	if err != nil || hit {
+		t.Fatalf("got (hit %v, %v), want a fresh successful lookup", hit, err)
+	}
+	if len(addrs) != 1 || addrs[0] != "1.2.3.4" {
+		t.Errorf("got %v, want [1.2.3.4]", addrs)
+	}
+	if _, hit, _ := r.LookupHostCached(context.Background(), "example.com"); !hit {
+		t.Error("real result was not cached")
+	}
+}
+
+func TestResolver_HealthCheck(t *testing.T) {
+	for _, cache := range []bool{false, true} {
+		t.Run(fmt.Sprint(cache), func(t *testing.T) {
+			f := &fakeResolver{hosts: map[string][]string{"canary.example.com": {"10.0.0.1"}}}
+			r := NewDNSResolver(128)
+			r.Resolver = f
+			r.CacheHealthCheck = cache
+			r.Set("canary.example.com", []string{"10.0.0.2"})
+
+			for i := 0; i < 2; i++ {
+				if err := r.HealthCheck(context.Background(), "canary.example.com"); err != nil {
+					t.Errorf("got %v, want a passing health check", err)
+				}
+			}
+			if got := f.callCount(); got != 2 {
+				t.Errorf("got %d upstream calls, want 2 as the cache is bypassed", got)
+			}
+			want := []string{"10.0.0.2"}
+			if cache {
+				want = []string{"10.0.0.1"}
+			}
+			if got, _ := r.LookupHost(context.Background(), "canary.example.com"); !reflect.DeepEqual(got, want) {
+				t.Errorf("got cached %v, want %v", got, want)
+			}
+
+			errFail := &net.DNSError{Err: "server misbehaving", Name: "canary.example.com", IsTemporary: true}
+			f.setErr(errFail)
+			if err := r.HealthCheck(context.Background(), "canary.example.com"); err != errFail {
+				t.Errorf("got %v, want %v", err, errFail)
+			}
+		})
+	}
+}
+
+func TestResolver_HealthCheckContext(t *testing.T) {
+	r := NewDNSResolver(128)
+	r.Resolver = &ctxResolver{errs: make(chan error, 1)}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := r.HealthCheck(ctx, "canary.example.com"); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if r.Len() != 0 {
+		t.Errorf("got %d entries, want 0", r.Len())
+	}
+}
+
+func TestResolver_OnEvict(t *testing.T) {
+	f := &fakeResolver{}
+	r := NewDNSResolver(2)
+	r.Resolver = f
+	var evicted []string
+	r.OnEvict = func(key string) {
+		// The cache lock is released, so the Resolver may be used.
+		r.Len()
+		evicted = append(evicted, key)
+	}
+	ctx := context.Background()
+
+	r.LookupHost(ctx, "a.com")
+	r.LookupHost(ctx, "b.com")
+	r.Remove("b.com")
+	r.LookupHost(ctx, "b.com")
+	r.LookupHost(ctx, "c.com")
+	if want := []string{"a.com"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("got evicted %v, want %v", evicted, want)
+	}
+	r.Set("d.com", nil)
+	r.Resize(1)
+	r.Clear()
+	if want := []string{"a.com", "b.com", "c.com"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("got evicted %v, want %v", evicted, want)
+	}
+}
+
+func TestResolver_RewriteBlock(t *testing.T) {
+	errBlocked := errors.New("blocked")
+	f := &fakeResolver{hosts: map[string][]string{"ads.example.com": {"192.0.2.1"}}}
+	r := NewDNSResolver(10)
+	r.Resolver = f
+	r.Rewrite = func(host string) (string, error) {
+		if strings.HasPrefix(host, "ads.") {
+			return "", errBlocked
+		}
+		return host, nil
+	}
+	r.RewriteAddr = func(addr string) (string, error) {
+		return "", errBlocked
+	}
+	if _, err := r.LookupHost(context.Background(), "ads.example.com"); err != errBlocked {
+		t.Errorf("got error %v, want %v", err, errBlocked)
+	}
+	if _, err := r.LookupAddr(context.Background(), "192.0.2.1"); err != errBlocked {
+		t.Errorf("got error %v, want %v", err, errBlocked)
+	}
+	if got := f.callCount(); got != 0 {
+		t.Errorf("got %d upstream calls, want 0", got)
+	}
+	if got := r.Len(); got != 0 {
+		t.Errorf("got %d cache entries, want 0", got)
+	}
+}
+
+func TestResolver_Rewrite(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{"db.internal.example.com": {"10.0.0.1"}}}
+	r := NewDNSResolver(10)
+	r.Resolver = f
+	r.Rewrite = func(host string) (string, error) {
+		if !strings.Contains(host, ".") {
+			host += ".internal.example.com"
+		}
+		return host, nil
+	}
+	for _, host := range []string{"db", "db.internal.example.com"} {
+		addrs, err := r.LookupHost(context.Background(), host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"10.0.0.1"}; !reflect.DeepEqual(addrs, want) {
+			t.Errorf("LookupHost(%q) = %v, want %v", host, addrs, want)
+		}
+	}
+	if got := f.callCount(); got != 1 {
+		t.Errorf("got %d upstream calls, want 1", got)
+	}
+	want := []interface{}{"hdb.internal.example.com"}
+	if keys := r.GetCacheKeys(); !reflect.DeepEqual(keys, want) {
+		t.Errorf("got keys %v, want %v", keys, want)
+	}
+}
+
+func TestResolver_InFlight(t *testing.T) {
+	b := &blockingResolver{addrs: []string{"192.0.2.1"}, release: make(chan struct{})}
+	r := NewDNSResolver(10)
+	r.Resolver = b
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.LookupHost(context.Background(), "example.com")
+	}()
+	deadline := time.Now().Add(time.Second)
+	for len(r.InFlight()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("lookup never reported in flight")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got, want := r.InFlight(), []string{"example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got in-flight %v, want %v", got, want)
+	}
+	close(b.release)
+	<-done
+	if got := r.InFlight(); len(got) != 0 {
+		t.Errorf("got in-flight %v after the lookup, want none", got)
+	}
+}
+
+func TestResolver_CaseInsensitive(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"192.0.2.1"}}}
+	r := NewDNSResolver(10)
+	r.Resolver = f
+	for _, host := range []string{"Example.COM", "example.com"} {
+		addrs, err := r.LookupHost(context.Background(), host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"192.0.2.1"}; !reflect.DeepEqual(addrs, want) {
+			t.Errorf("LookupHost(%q) = %v, want %v", host, addrs, want)
+		}
+	}
+	if got := f.callCount(); got != 1 {
+		t.Errorf("got %d upstream calls, want 1", got)
+	}
+	if got := r.Len(); got != 1 {
+		t.Errorf("got %d cache entries, want 1", got)
+	}
+
+	r.CaseSensitive = true
+	r.LookupHost(context.Background(), "Example.COM")
+	if got := r.Len(); got != 2 {
+		t.Errorf("got %d cache entries with CaseSensitive, want 2", got)
+	}
+}
+
+func TestResolver_MaxFailureBackoff(t *testing.T) {
+	clock := newFakeClock()
+	f := &fakeResolver{err: errLookup}
+	r := NewDNSResolver(10)
+	r.Resolver = f
+	r.TTL = time.Second
+	r.NegativeTTL = time.Second
+	r.MaxFailureBackoff = 8 * time.Second
+	r.Rand = rand.New(rand.NewSource(1))
+	r.clock = clock
+
+	// intervals returns the time between the next n upstream lookups.
+	const step = 100 * time.Millisecond
+	intervals := func(n int) []time.Duration {
+		var out []time.Duration
+		r.LookupHost(context.Background(), "example.com")
+		calls := f.callCount()
+		var elapsed time.Duration
+		for len(out) < n {
+			clock.Advance(step)
+			elapsed += step
+			r.LookupHost(context.Background(), "example.com")
+			if got := f.callCount(); got != calls {
+				calls = got
+				out = append(out, elapsed)
+				elapsed = 0
+			}
+		}
+		return out
+	}
+
+	max := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second, 8 * time.Second}
+	for i, got := range intervals(len(max)) {
+		min := max[i] / 2
+		if i == 0 {
+			min = max[i]
+		}
+		if got < min || got > max[i]+step {
+			t.Errorf("retry %d after %v, want between %v and %v", i+1, got, min, max[i])
+		}
+	}
+
+	// A success resets the backoff.
+	f.setErr(nil)
+	clock.Advance(8 * time.Second)
+	r.LookupHost(context.Background(), "example.com")
+	f.setErr(errLookup)
+	clock.Advance(time.Second)
+	if got := intervals(1); got[0] != time.Second {
+		t.Errorf("retry after success and failure after %v, want %v", got[0], time.Second)
+	}
+}
+
+func TestResolver_OnLookup(t *testing.T) {
+	type call struct {
+		kind    byte
+		subject string
+		addrs   []string
+		err     error
+		hit     bool
+	}
+	var calls []call
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"192.0.2.1", "192.0.2.2"}}}
+	r := NewDNSResolver(10)
+	r.Resolver = f
+	r.OnLookup = func(kind byte, subject string, addrs []string, err error, hit bool) {
+		calls = append(calls, call{kind, subject, addrs, err, hit})
+	}
+
+	r.LookupHost(context.Background(), "example.com")
+	r.LookupHost(context.Background(), "example.com")
+	f.setErr(errLookup)
+	r.LookupAddr(context.Background(), "192.0.2.1")
+
+	want := []call{
+		{KindHost, "example.com", []string{"192.0.2.1", "192.0.2.2"}, nil, false},
+		{KindHost, "example.com", []string{"192.0.2.1", "192.0.2.2"}, nil, true},
+		{KindAddr, "192.0.2.1", nil, errLookup, false},
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("got calls %+v, want %+v", calls, want)
+	}
+}
+
+func TestResolver_InvalidInput(t *testing.T) {
+	tests := []struct {
+		name   string
+		lookup func(r *Resolver) error
+	}{
+		{"empty host", func(r *Resolver) error {
+			_, err := r.LookupHost(context.Background(), "")
+			return err
+		}},
+		{"long host", func(r *Resolver) error {
+			_, err := r.LookupHost(context.Background(), strings.Repeat("a.", 127)+"com")
+			return err
+		}},
+		{"null byte", func(r *Resolver) error {
+			_, err := r.LookupHost(context.Background(), "example.com\x00.evil")
+			return err
+		}},
+		{"health check of long host", func(r *Resolver) error {
+			return r.HealthCheck(context.Background(), strings.Repeat("a.", 127)+"com")
+		}},
+		{"stale lookup of empty host", func(r *Resolver) error {
+			_, _, err := r.LookupHostStale(context.Background(), "")
+			return err
+		}},
+		{"address", func(r *Resolver) error {
+			_, err := r.LookupAddr(context.Background(), "example.com")
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeResolver{}
+			r := NewDNSResolver(10)
+			r.Resolver = f
+			if err := tt.lookup(r); !errors.Is(err, ErrInvalidName) {
+				t.Errorf("got error %v, want ErrInvalidName", err)
+			}
+			if got := f.callCount(); got != 0 {
+				t.Errorf("got %d upstream calls, want 0", got)
+			}
+			if got := r.Len(); got != 0 {
+				t.Errorf("got %d cache entries, want 0", got)
+			}
+		})
+	}
+
+	// The longest valid name is accepted, with or without trailing dot.
+	r := NewDNSResolver(10)
+	r.Resolver = &fakeResolver{}
+	name := strings.Repeat("a.", 125) + "com"
+	for _, host := range []string{name, name + "."} {
+		if _, err := r.LookupHost(context.Background(), host); err != nil {
+			t.Errorf("LookupHost of %d bytes: %v", len(host), err)
+		}
+	}
+}
+
+func TestResolver_AsyncCallbacks(t *testing.T) {
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	slow := func() {
+		defer wg.Done()
+		<-release
+	}
+	r := NewDNSResolver(10)
+	r.Resolver = &fakeResolver{}
+	r.OnCacheMiss = slow
+	r.OnCacheHit = slow
+	r.AsyncCallbacks = true
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.LookupHost(context.Background(), "example.com")
+		r.LookupHost(context.Background(), "example.com")
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("lookups blocked by slow callbacks")
+	}
+	close(release)
+	wg.Wait()
+}
+
+func TestResolver_SortedKeys(t *testing.T) {
+	r := NewDNSResolver(10)
+	r.Resolver = &fakeResolver{}
+	ctx := context.Background()
+	r.LookupHost(ctx, "b.example.com")
+	r.LookupAddr(ctx, "192.0.2.1")
+	r.LookupHost(ctx, "a.example.com")
+
+	want := []Key{
+		{Kind: KindHost, Subject: "a.example.com"},
+		{Kind: KindHost, Subject: "b.example.com"},
+		{Kind: KindAddr, Subject: "192.0.2.1"},
+	}
+	if got := r.SortedKeys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Using entries changes their LRU order, not the sorted one.
+	r.LookupHost(ctx, "b.example.com")
+	r.LookupAddr(ctx, "192.0.2.1")
+	if got := r.SortedKeys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after lookups, got %v, want %v", got, want)
+	}
+}
+
+func TestResolver_Expire(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"192.0.2.1"}}}
+	r := NewDNSResolver(10)
+	r.Resolver = f
+	r.ServeStale = true
+	r.TransientErrorTTL = time.Minute
+
+	r.LookupHost(context.Background(), "example.com")
+	r.Expire()
+	if got := r.Len(); got != 1 {
+		t.Errorf("got %d entries after Expire, want 1", got)
+	}
+	f.setHosts(map[string][]string{"example.com": {"192.0.2.2"}})
+	addrs, err := r.LookupHost(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"192.0.2.2"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("got %v, want %v", addrs, want)
+	}
+	if got := f.callCount(); got != 2 {
+		t.Errorf("got %d upstream calls, want 2", got)
+	}
+
+	// The stale result is served if the upstream fails.
+	r.Expire()
+	f.setErr(&net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true})
+	addrs, err = r.LookupHost(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"192.0.2.2"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("got %v, want stale %v", addrs, want)
+	}
+	if got := f.callCount(); got != 3 {
+		t.Errorf("got %d upstream calls, want 3", got)
+	}
+}
+
+func TestResolver_TryLookupHost(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"1.2.3.4"}}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	misses := 0
+	r.OnCacheMiss = func() { misses++ }
+
+	if addrs, ok := r.TryLookupHost("example.com"); ok || addrs != nil {
+		t.Errorf("got (%v, %v) for an uncached host, want (nil, false)", addrs, ok)
+	}
+	if got := f.callCount(); got != 0 {
+		t.Errorf("got %d upstream lookups, want 0", got)
+	}
+	if misses != 0 || r.Stats().Misses != 0 {
+		t.Errorf("got %d cache misses, want 0", misses)
+	}
+
+	r.LookupHost(context.Background(), "example.com")
+	if addrs, ok := r.TryLookupHost("Example.com"); !ok || !reflect.DeepEqual(addrs, []string{"1.2.3.4"}) {
+		t.Errorf("got (%v, %v) for a cached host, want ([1.2.3.4], true)", addrs, ok)
+	}
+	if _, ok := r.TryLookupHost("unknown.com"); ok {
+		t.Error("got ok for an uncached host")
+	}
+	if got := f.callCount(); got != 1 {
+		t.Errorf("got %d upstream lookups, want 1", got)
+	}
+}
@@ -0,0 +1,90 @@
+package dnscache
+
+import (
+	"errors"
+	"net"
+)
+
+// Sentinel errors reporting the class of lookup errors served from the cache.
+// Cached errors retain the message and class of the original error only, so
+// they do not keep large error values alive in the cache; the lookup calling
+// the upstream resolver returns the original error. The classes are:
+//
+//   - a *net.DNSError with IsNotFound matches ErrNotFound,
+//   - a *net.DNSError with IsTimeout, or another net.Error reporting a
+//     timeout, matches ErrTimeout,
+//   - a *net.DNSError with IsTemporary matches ErrTemporary.
+//
+// Use errors.Is to test for them. A *net.DNSError holding the name, server
+// and flags of the original DNS error is still available with errors.As, and
+// cached errors implement net.Error. IsRetryable tells whether an error is
+// worth retrying.
+var (
+	ErrNotFound  = errors.New("dnscache: no such host")
+	ErrTimeout   = errors.New("dnscache: lookup timed out")
+	ErrTemporary = errors.New("dnscache: temporary lookup failure")
+)
+
+// cachedError is the lightweight form of a lookup error stored in the cache.
+type cachedError struct {
+	msg   string
+	class error
+	dns   *net.DNSError
+}
+
+func (e *cachedError) Error() string { return e.msg }
+
+// Is reports whether target is the sentinel error of the class of e.
+func (e *cachedError) Is(target error) bool {
+	return e.class != nil && target == e.class
+}
+
+// Timeout reports whether e is of the ErrTimeout class, so cached errors
+// implement net.Error like the original ones.
+func (e *cachedError) Timeout() bool { return e.class == ErrTimeout }
+
+// Temporary reports whether e is of the ErrTimeout or ErrTemporary class.
+func (e *cachedError) Temporary() bool {
+	return e.class == ErrTimeout || e.class == ErrTemporary
+}
+
+// Unwrap returns the copy of the original *net.DNSError, if any.
+func (e *cachedError) Unwrap() error {
+	if e.dns == nil {
+		return nil
+	}
+	return e.dns
+}
+
+// lightError returns the lightweight form of err to store in the cache,
+// keeping only its message and class.
+func lightError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*cachedError); ok {
+		return err
+	}
+	e := &cachedError{msg: err.Error()}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		e.dns = &net.DNSError{
+			Err:         dnsErr.Err,
+			Name:        dnsErr.Name,
+			Server:      dnsErr.Server,
+			IsTimeout:   dnsErr.IsTimeout,
+			IsTemporary: dnsErr.IsTemporary,
+			IsNotFound:  dnsErr.IsNotFound,
+		}
+	}
+	var netErr net.Error
+	switch {
+	case e.dns != nil && e.dns.IsNotFound:
+		e.class = ErrNotFound
+	case e.dns != nil && e.dns.IsTimeout, errors.As(err, &netErr) && netErr.Timeout():
+		e.class = ErrTimeout
+	case e.dns != nil && e.dns.IsTemporary:
+		e.class = ErrTemporary
+	}
+	return e
+}
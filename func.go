@@ -0,0 +1,27 @@
+package dnscache
+
+import "context"
+
+// FuncResolver is a DNSResolver calling functions, e.g. to back a Resolver
+// with closures in tests. A lookup whose function is nil fails with
+// ErrNotSupported.
+type FuncResolver struct {
+	HostFunc func(ctx context.Context, host string) ([]string, error)
+	AddrFunc func(ctx context.Context, addr string) ([]string, error)
+}
+
+// LookupHost calls HostFunc.
+func (f FuncResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if f.HostFunc == nil {
+		return nil, ErrNotSupported
+	}
+	return f.HostFunc(ctx, host)
+}
+
+// LookupAddr calls AddrFunc.
+func (f FuncResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if f.AddrFunc == nil {
+		return nil, ErrNotSupported
+	}
+	return f.AddrFunc(ctx, addr)
+}
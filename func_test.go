@@ -0,0 +1,36 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestFuncResolver(t *testing.T) {
+	calls := 0
+	r, err := New(WithResolver(FuncResolver{
+		HostFunc: func(ctx context.Context, host string) ([]string, error) {
+			calls++
+			return []string{"192.0.2.1"}, nil
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		addrs, err := r.LookupHost(context.Background(), "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"192.0.2.1"}; !reflect.DeepEqual(addrs, want) {
+			t.Errorf("got %v, want %v", addrs, want)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls, want 1", calls)
+	}
+	if _, err := r.LookupAddr(context.Background(), "192.0.2.1"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("got error %v, want ErrNotSupported", err)
+	}
+}
@@ -1,5 +1,8 @@
 module github.com/publica-project/dnscache
 
-go 1.12
+go 1.13
 
-require golang.org/x/sync v0.0.0-20190423024810-112230192c58
+require (
+	github.com/hashicorp/golang-lru v1.0.2
+	golang.org/x/sync v0.0.0-20190423024810-112230192c58
+)
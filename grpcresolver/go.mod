@@ -0,0 +1,15 @@
+module github.com/publica-project/dnscache/grpcresolver
+
+go 1.25.0
+
+require (
+	github.com/publica-project/dnscache v0.0.0-20261014065128-1f68105d0281
+	google.golang.org/grpc v1.84.0
+)
+
+require (
+	github.com/hashicorp/golang-lru v1.0.2 // indirect
+	golang.org/x/sync v0.22.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	google.golang.org/protobuf v1.36.11 // indirect
+)
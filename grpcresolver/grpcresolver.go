@@ -0,0 +1,157 @@
+// Package grpcresolver provides a gRPC name resolver backed by a
+// dnscache.Resolver, so gRPC client connections resolve their targets from
+// the cache.
+//
+// It is a separate module so that the dnscache package does not depend on
+// gRPC.
+package grpcresolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/publica-project/dnscache"
+	"google.golang.org/grpc/resolver"
+)
+
+// defaultPort is the port used for targets without one, as by the dns
+// resolver of gRPC.
+const defaultPort = "443"
+
+// Builder is a resolver.Builder creating resolvers of "host:port" targets,
+// such as "dnscache:///example.com:50051", looking hosts up in its cache.
+type Builder struct {
+	cache  *dnscache.Resolver
+	scheme string
+}
+
+// NewBuilder returns a Builder resolving the targets of the given scheme with
+// cache.
+func NewBuilder(cache *dnscache.Resolver, scheme string) *Builder {
+	return &Builder{cache: cache, scheme: scheme}
+}
+
+// Register registers a Builder resolving the targets of the given scheme with
+// cache, so that grpc.Dial("scheme:///host:port") uses it. Like
+// resolver.Register, it must only be called at initialization time.
+func Register(cache *dnscache.Resolver, scheme string) {
+	resolver.Register(NewBuilder(cache, scheme))
+}
+
+// Scheme returns the scheme of the targets resolved by b.
+func (b *Builder) Scheme() string {
+	return b.scheme
+}
+
+// Build creates a resolver for target, reporting the addresses of its host to
+// cc. The first resolution is done from the cache; the following ones,
+// requested by gRPC with ResolveNow, refresh the cached entry.
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	host, port, err := splitTarget(target.Endpoint())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &grpcResolver{
+		cache:  b.cache,
+		host:   host,
+		port:   port,
+		cc:     cc,
+		cancel: cancel,
+		rn:     make(chan struct{}, 1),
+	}
+	r.wg.Add(1)
+	go r.watch(ctx)
+	return r, nil
+}
+
+// splitTarget returns the host and port of the endpoint of a target.
+func splitTarget(endpoint string) (host, port string, err error) {
+	if endpoint == "" {
+		return "", "", errors.New("grpcresolver: missing target address")
+	}
+	host, port, err = net.SplitHostPort(endpoint)
+	if err != nil {
+		// The endpoint has no port, or is a bare IPv6 address.
+		host = strings.TrimSuffix(strings.TrimPrefix(endpoint, "["), "]")
+		port = defaultPort
+	}
+	if host == "" {
+		return "", "", errors.New("grpcresolver: missing host in target address")
+	}
+	if port == "" {
+		port = defaultPort
+	}
+	return host, port, nil
+}
+
+// grpcResolver is the resolver.Resolver of one target.
+type grpcResolver struct {
+	cache      *dnscache.Resolver
+	host, port string
+	cc         resolver.ClientConn
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// rn holds the pending ResolveNow request, if any.
+	rn chan struct{}
+}
+
+// ResolveNow requests the addresses of the target to be refreshed.
+func (r *grpcResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.rn <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops the resolver, waiting for a resolution in progress to end.
+func (r *grpcResolver) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// watch resolves the target once from the cache, then again upstream on each
+// ResolveNow request until ctx is done.
+func (r *grpcResolver) watch(ctx context.Context) {
+	defer r.wg.Done()
+	r.resolve(ctx, false)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.rn:
+			r.resolve(ctx, true)
+		}
+	}
+}
+
+// resolve reports the addresses of the target to the ClientConn, refreshing
+// its cache entry first if refresh is set.
+func (r *grpcResolver) resolve(ctx context.Context, refresh bool) {
+	var addrs []string
+	var err error
+	switch {
+	case net.ParseIP(r.host) != nil:
+		addrs = []string{r.host}
+	case refresh:
+		addrs, err = r.cache.RefreshKey(ctx, r.host)
+	default:
+		addrs, err = r.cache.LookupHost(ctx, r.host)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		r.cc.ReportError(err)
+		return
+	}
+	state := resolver.State{Addresses: make([]resolver.Address, len(addrs))}
+	for i, addr := range addrs {
+		state.Addresses[i] = resolver.Address{Addr: net.JoinHostPort(addr, r.port)}
+	}
+	r.cc.UpdateState(state)
+}
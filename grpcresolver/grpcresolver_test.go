@@ -0,0 +1,217 @@
+package grpcresolver
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/publica-project/dnscache"
+	"google.golang.org/grpc/resolver"
+)
+
+// fakeClientConn is a resolver.ClientConn recording the reported states and
+// errors.
+type fakeClientConn struct {
+	resolver.ClientConn
+	states chan resolver.State
+	errs   chan error
+}
+
+func newFakeClientConn() *fakeClientConn {
+	return &fakeClientConn{states: make(chan resolver.State, 10), errs: make(chan error, 10)}
+}
+
+func (c *fakeClientConn) UpdateState(state resolver.State) error {
+	c.states <- state
+	return nil
+}
+
+func (c *fakeClientConn) ReportError(err error) {
+	c.errs <- err
+}
+
+// state returns the next state reported to c.
+func (c *fakeClientConn) state(t *testing.T) resolver.State {
+	select {
+	case state := <-c.states:
+		return state
+	case err := <-c.errs:
+		t.Fatalf("got error %v, want a state", err)
+	case <-time.After(time.Second):
+		t.Fatal("no state reported")
+	}
+	return resolver.State{}
+}
+
+// hostResolver is a dnscache.DNSResolver serving addresses from a map.
+type hostResolver struct {
+	mu    sync.Mutex
+	hosts map[string][]string
+	calls int
+}
+
+func (h *hostResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls++
+	if addrs, ok := h.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (h *hostResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (h *hostResolver) callCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls
+}
+
+func (h *hostResolver) set(host string, addrs []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hosts[host] = addrs
+}
+
+func parseTarget(t *testing.T, target string) resolver.Target {
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resolver.Target{URL: *u}
+}
+
+func addrs(state resolver.State) []string {
+	var addrs []string
+	for _, addr := range state.Addresses {
+		addrs = append(addrs, addr.Addr)
+	}
+	return addrs
+}
+
+func TestBuilder(t *testing.T) {
+	h := &hostResolver{hosts: map[string][]string{"example.com": {"192.0.2.1", "2001:db8::1"}}}
+	cache, err := dnscache.New(dnscache.WithResolver(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.LookupHost(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuilder(cache, "dnscache")
+	if b.Scheme() != "dnscache" {
+		t.Errorf("got scheme %q, want dnscache", b.Scheme())
+	}
+	cc := newFakeClientConn()
+	r, err := b.Build(parseTarget(t, "dnscache:///example.com:50051"), cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	want := []string{"192.0.2.1:50051", "[2001:db8::1]:50051"}
+	if got := addrs(cc.state(t)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got addresses %v, want %v", got, want)
+	}
+	if h.callCount() != 1 {
+		t.Errorf("got %d upstream lookups, want the first resolution served from the cache", h.callCount())
+	}
+
+	// ResolveNow refreshes the cached entry.
+	h.set("example.com", []string{"192.0.2.2"})
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	if got, want := addrs(cc.state(t)), []string{"192.0.2.2:50051"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got addresses %v after ResolveNow, want %v", got, want)
+	}
+	if got, _ := cache.LookupHost(context.Background(), "example.com"); !reflect.DeepEqual(got, []string{"192.0.2.2"}) {
+		t.Errorf("got cached %v after ResolveNow, want [192.0.2.2]", got)
+	}
+}
+
+func TestBuilder_Errors(t *testing.T) {
+	cache, err := dnscache.New(dnscache.WithResolver(&hostResolver{hosts: map[string][]string{}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuilder(cache, "dnscache")
+	cc := newFakeClientConn()
+	r, err := b.Build(parseTarget(t, "dnscache:///missing.example.com"), cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	select {
+	case err := <-cc.errs:
+		if err == nil {
+			t.Error("got nil error reported")
+		}
+	case state := <-cc.states:
+		t.Errorf("got state %v, want an error", state)
+	case <-time.After(time.Second):
+		t.Fatal("no error reported")
+	}
+
+	if _, err := b.Build(parseTarget(t, "dnscache:///"), cc, resolver.BuildOptions{}); err == nil {
+		t.Error("got nil error for an empty target")
+	}
+}
+
+func TestSplitTarget(t *testing.T) {
+	for endpoint, want := range map[string][2]string{
+		"example.com:50051": {"example.com", "50051"},
+		"example.com":       {"example.com", defaultPort},
+		"192.0.2.1:80":      {"192.0.2.1", "80"},
+		"[2001:db8::1]:80":  {"2001:db8::1", "80"},
+		"[2001:db8::1]":     {"2001:db8::1", defaultPort},
+		"2001:db8::1":       {"2001:db8::1", defaultPort},
+		"example.com:":      {"example.com", defaultPort},
+	} {
+		host, port, err := splitTarget(endpoint)
+		if err != nil || host != want[0] || port != want[1] {
+			t.Errorf("splitTarget(%q) = (%q, %q, %v), want (%q, %q)", endpoint, host, port, err, want[0], want[1])
+		}
+	}
+	for _, endpoint := range []string{"", ":50051"} {
+		if _, _, err := splitTarget(endpoint); err == nil {
+			t.Errorf("splitTarget(%q): got nil error", endpoint)
+		}
+	}
+}
+
+func TestBuilder_IPTarget(t *testing.T) {
+	h := &hostResolver{hosts: map[string][]string{}}
+	cache, err := dnscache.New(dnscache.WithResolver(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := newFakeClientConn()
+	r, err := NewBuilder(cache, "dnscache").Build(parseTarget(t, "dnscache:///192.0.2.1:50051"), cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got, want := addrs(cc.state(t)), []string{"192.0.2.1:50051"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got addresses %v, want %v", got, want)
+	}
+	if h.callCount() != 0 {
+		t.Errorf("got %d upstream lookups for an IP target, want 0", h.callCount())
+	}
+}
+
+func TestRegister(t *testing.T) {
+	cache, err := dnscache.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Register(cache, "dnscache-test")
+	if b := resolver.Get("dnscache-test"); b == nil || b.Scheme() != "dnscache-test" {
+		t.Errorf("got builder %v registered, want a dnscache-test one", b)
+	}
+}
@@ -0,0 +1,217 @@
+package dnscache
+
+import (
+	"container/heap"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// EvictionPolicy selects the entries evicted from a full cache.
+type EvictionPolicy int
+
+const (
+	// LRU evicts the least recently used entry.
+	LRU EvictionPolicy = iota
+	// LFU evicts the least frequently used entry, and the least recently
+	// used one among entries used equally often. It retains hot entries
+	// better when other entries are looked up in short bursts.
+	LFU
+)
+
+// lfuCache is a Cache of bounded size evicting its least frequently used
+// entries. It implements resizer and oldestRemover like the LRU cache.
+type lfuCache struct {
+	mu      sync.Mutex
+	size    int
+	items   map[interface{}]*lfuItem
+	queue   lfuQueue
+	seq     uint64
+	onEvict func(key, value interface{})
+}
+
+// lfuItem is an entry of an lfuCache.
+type lfuItem struct {
+	key, value interface{}
+	// hits and seq, the time of the last use, order items in the queue.
+	hits  uint64
+	seq   uint64
+	index int
+}
+
+// newLFU creates an lfuCache holding up to size entries. onEvict, if not nil,
+// is called with the entries evicted, removed or purged.
+func newLFU(size int, onEvict func(key, value interface{})) (*lfuCache, error) {
+	if size <= 0 {
+		return nil, errors.New("dnscache: cache size must be positive")
+	}
+	return &lfuCache{
+		size:    size,
+		items:   map[interface{}]*lfuItem{},
+		onEvict: onEvict,
+	}, nil
+}
+
+// touch records a use of item. c.mu must be held.
+func (c *lfuCache) touch(item *lfuItem) {
+	c.seq++
+	item.hits++
+	item.seq = c.seq
+	heap.Fix(&c.queue, item.index)
+}
+
+// removeItem removes item and calls onEvict. c.mu must be held.
+func (c *lfuCache) removeItem(item *lfuItem) {
+	heap.Remove(&c.queue, item.index)
+	delete(c.items, item.key)
+	if c.onEvict != nil {
+		c.onEvict(item.key, item.value)
+	}
+}
+
+// Get returns the value stored for key, counting a use of it.
+func (c *lfuCache) Get(key interface{}) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.touch(item)
+	return item.value, true
+}
+
+// Peek returns the value stored for key without counting a use of it.
+func (c *lfuCache) Peek(key interface{}) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	return item.value, true
+}
+
+// Add stores value for key and evicts the least frequently used entry if the
+// cache is full. Replacing the value of a key does not count as a use.
+func (c *lfuCache) Add(key, value interface{}) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if item, ok := c.items[key]; ok {
+		item.value = value
+		return false
+	}
+	evicted := false
+	if len(c.items) >= c.size {
+		c.removeItem(c.queue[0])
+		evicted = true
+	}
+	c.seq++
+	item := &lfuItem{key: key, value: value, hits: 1, seq: c.seq}
+	c.items[key] = item
+	heap.Push(&c.queue, item)
+	return evicted
+}
+
+// Remove removes key, reporting whether it was present.
+func (c *lfuCache) Remove(key interface{}) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.items[key]
+	if ok {
+		c.removeItem(item)
+	}
+	return ok
+}
+
+// RemoveOldest removes the least frequently used entry.
+func (c *lfuCache) RemoveOldest() (key, value interface{}, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.queue) == 0 {
+		return nil, nil, false
+	}
+	item := c.queue[0]
+	c.removeItem(item)
+	return item.key, item.value, true
+}
+
+// Keys returns the stored keys, from the first to the last to be evicted.
+func (c *lfuCache) Keys() []interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	items := append(lfuQueue(nil), c.queue...)
+	sort.Slice(items, func(i, j int) bool { return items.Less(i, j) })
+	keys := make([]interface{}, len(items))
+	for i, item := range items {
+		keys[i] = item.key
+	}
+	return keys
+}
+
+// Purge removes all entries.
+func (c *lfuCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	items := c.queue
+	c.items = map[interface{}]*lfuItem{}
+	c.queue = nil
+	if c.onEvict != nil {
+		for _, item := range items {
+			c.onEvict(item.key, item.value)
+		}
+	}
+}
+
+// Len returns the number of stored entries.
+func (c *lfuCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+// Resize changes the maximum number of entries, evicting the least
+// frequently used ones if needed.
+func (c *lfuCache) Resize(size int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	evicted := 0
+	for len(c.items) > size {
+		c.removeItem(c.queue[0])
+		evicted++
+	}
+	c.size = size
+	return evicted
+}
+
+// lfuQueue is a heap of items, with the next item to evict first.
+type lfuQueue []*lfuItem
+
+func (q lfuQueue) Len() int { return len(q) }
+
+func (q lfuQueue) Less(i, j int) bool {
+	if q[i].hits != q[j].hits {
+		return q[i].hits < q[j].hits
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q lfuQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *lfuQueue) Push(x interface{}) {
+	item := x.(*lfuItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *lfuQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,115 @@
+package dnscache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestResolver_EvictionPolicy(t *testing.T) {
+	// hotMisses returns the number of upstream lookups of 5 hot hosts after a
+	// burst of lookups of 50 other hosts, with a cache of 10 entries.
+	hotMisses := func(policy EvictionPolicy) int {
+		f := &fakeResolver{}
+		r, err := New(WithCacheSize(10), WithShards(1), WithEvictionPolicy(policy), WithResolver(f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		for i := 0; i < 20; i++ {
+			for j := 0; j < 5; j++ {
+				r.LookupHost(ctx, fmt.Sprintf("hot%d.com", j))
+			}
+		}
+		for i := 0; i < 50; i++ {
+			r.LookupHost(ctx, fmt.Sprintf("burst%d.com", i))
+		}
+		if got := r.Len(); got != 10 {
+			t.Errorf("policy %d: got %d entries, want 10", policy, got)
+		}
+		calls := f.callCount()
+		for j := 0; j < 5; j++ {
+			r.LookupHost(ctx, fmt.Sprintf("hot%d.com", j))
+		}
+		return f.callCount() - calls
+	}
+	if got := hotMisses(LFU); got != 0 {
+		t.Errorf("LFU: got %d hot hosts evicted, want 0", got)
+	}
+	if got := hotMisses(LRU); got != 5 {
+		t.Errorf("LRU: got %d hot hosts evicted, want 5", got)
+	}
+
+	if _, err := New(WithEvictionPolicy(EvictionPolicy(-1))); err == nil {
+		t.Error("got no error for an unknown policy")
+	}
+}
+
+func TestLFUCache(t *testing.T) {
+	var evicted []interface{}
+	c, err := newLFU(3, func(key, _ interface{}) { evicted = append(evicted, key) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Add("c", 3)
+	c.Get("a")
+	c.Get("a")
+	c.Get("c")
+	if got, want := c.Keys(), []interface{}{"b", "c", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got keys %v, want %v", got, want)
+	}
+	if !c.Add("d", 4) {
+		t.Error("Add on a full cache reported no eviction")
+	}
+	if v, ok := c.Peek("b"); ok {
+		t.Errorf("got %v for the least frequently used key, want it evicted", v)
+	}
+	if c.Add("d", 5) {
+		t.Error("replacing a value reported an eviction")
+	}
+	if v, _ := c.Get("d"); v != 5 {
+		t.Errorf("got %v, want 5", v)
+	}
+	if n := c.Resize(1); n != 2 || c.Len() != 1 {
+		t.Errorf("Resize(1) evicted %d leaving %d entries, want 2 and 1", n, c.Len())
+	}
+	if key, _, ok := c.RemoveOldest(); !ok || key != "a" {
+		t.Errorf("RemoveOldest removed %v, want a", key)
+	}
+	if want := []interface{}{"b", "c", "d", "a"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("got evicted keys %v, want %v", evicted, want)
+	}
+	if _, err := newLFU(0, nil); err == nil {
+		t.Error("got no error for a zero size")
+	}
+}
+
+func TestResolver_EvictionPolicyReadOnly(t *testing.T) {
+	for _, policy := range []EvictionPolicy{LRU, LFU} {
+		f := &fakeResolver{}
+		r, err := New(WithCacheSize(3), WithShards(1), WithEvictionPolicy(policy), WithResolver(f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		for _, host := range []string{"a.com", "b.com", "c.com", "b.com", "c.com"} {
+			r.LookupHost(ctx, host)
+		}
+		// Inspecting an entry does not count as a use of it.
+		a := Key{Kind: KindHost, Subject: "a.com"}
+		for i := 0; i < 5; i++ {
+			r.EntryInfo(a)
+			r.Snapshot()
+			r.SortedKeys()
+			r.Save(&bytes.Buffer{})
+		}
+		r.LookupHost(ctx, "d.com")
+		if _, _, ok := r.EntryInfo(a); ok {
+			t.Errorf("policy %d: inspected entry was not evicted", policy)
+		}
+	}
+}
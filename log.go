@@ -0,0 +1,47 @@
+package dnscache
+
+import (
+	"context"
+	"time"
+)
+
+// Logger receives an event for each lookup.
+type Logger interface {
+	Log(event LookupEvent)
+}
+
+// LookupEvent describes a completed lookup.
+type LookupEvent struct {
+	// Context is the context passed to the lookup, carrying the span of the
+	// lookup if a Tracer is set, e.g. to log the ID of the request that
+	// triggered the lookup.
+	Context context.Context
+	// Kind is the type of lookup, one of the Kind constants.
+	Kind byte
+	// Subject is the looked up host, address or domain name.
+	Subject string
+	// CacheHit reports whether the result was served from the cache.
+	CacheHit bool
+	// Duration is the time taken by the lookup.
+	Duration time.Duration
+	// Results is the number of records returned.
+	Results int
+	// Err is the error returned by the lookup.
+	Err error
+}
+
+// logLookup sends a LookupEvent to the Logger, if any.
+func (r *Resolver) logLookup(ctx context.Context, key cacheKey, hit bool, start time.Time, val interface{}, err error) {
+	if r.Logger == nil {
+		return
+	}
+	r.Logger.Log(LookupEvent{
+		Context:  ctx,
+		Kind:     key.kind,
+		Subject:  key.subject,
+		CacheHit: hit,
+		Duration: time.Since(start),
+		Results:  resultCount(val),
+		Err:      err,
+	})
+}
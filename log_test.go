@@ -0,0 +1,90 @@
+package dnscache
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type captureLogger struct {
+	mu     sync.Mutex
+	events []LookupEvent
+}
+
+func (l *captureLogger) Log(event LookupEvent) {
+	l.mu.Lock()
+	l.events = append(l.events, event)
+	l.mu.Unlock()
+}
+
+func TestResolver_Logger(t *testing.T) {
+	logger := &captureLogger{}
+	f := &fakeResolver{
+		hosts: map[string][]string{"example.com": {"1.1.1.1", "2.2.2.2"}},
+		addrs: map[string][]string{"1.1.1.1": {"example.com."}},
+	}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.Logger = logger
+
+	ctx := context.Background()
+	r.LookupHost(ctx, "example.com")
+	r.LookupHost(ctx, "example.com")
+	r.LookupAddr(ctx, "1.1.1.1")
+	f.setErr(errLookup)
+	r.LookupHost(ctx, "fail.com")
+
+	want := []LookupEvent{
+		{Kind: KindHost, Subject: "example.com", CacheHit: false, Results: 2},
+		{Kind: KindHost, Subject: "example.com", CacheHit: true, Results: 2},
+		{Kind: KindAddr, Subject: "1.1.1.1", CacheHit: false, Results: 1},
+		{Kind: KindHost, Subject: "fail.com", CacheHit: false, Err: errLookup},
+	}
+	if len(logger.events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(logger.events), len(want))
+	}
+	for i, got := range logger.events {
+		if got.Duration < 0 {
+			t.Errorf("event %d: got negative duration %v", i, got.Duration)
+		}
+		if got.Context != ctx {
+			t.Errorf("event %d: got context %v, want the lookup context", i, got.Context)
+		}
+		got.Duration = 0
+		got.Context = nil
+		if got != want[i] {
+			t.Errorf("event %d: got %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+type requestIDKey struct{}
+
+func TestResolver_LoggerContext(t *testing.T) {
+	var ids, upstreamIDs []interface{}
+	r := NewDNSResolver(128)
+	r.Resolver = FuncResolver{HostFunc: func(ctx context.Context, host string) ([]string, error) {
+		upstreamIDs = append(upstreamIDs, ctx.Value(requestIDKey{}))
+		return nil, nil
+	}}
+	r.Logger = loggerFunc(func(event LookupEvent) {
+		ids = append(ids, event.Context.Value(requestIDKey{}))
+	})
+	r.Tracer = &fakeTracer{}
+
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "req-1")
+	r.LookupHost(ctx, "example.com")
+	r.LookupHost(ctx, "example.com")
+	if want := []interface{}{"req-1", "req-1"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got request IDs %v, want %v", ids, want)
+	}
+	if want := []interface{}{"req-1"}; !reflect.DeepEqual(upstreamIDs, want) {
+		t.Errorf("got upstream request IDs %v, want %v", upstreamIDs, want)
+	}
+}
+
+// loggerFunc adapts a function to the Logger interface.
+type loggerFunc func(event LookupEvent)
+
+func (f loggerFunc) Log(event LookupEvent) { f(event) }
@@ -0,0 +1,43 @@
+package dnscache
+
+import "time"
+
+// Metrics receives measurements of the resolver, e.g. to feed Prometheus
+// collectors or a statsd client.
+type Metrics interface {
+	// IncHit is called for each lookup served from the cache.
+	IncHit()
+	// IncMiss is called for each lookup not served from the cache.
+	IncMiss()
+	// ObserveLookup is called after each upstream lookup with its duration
+	// and error.
+	ObserveLookup(d time.Duration, err error)
+	// SetCacheSize is called with the number of cache entries whenever
+	// entries are added or removed.
+	SetCacheSize(n int)
+}
+
+// NopMetrics is a Metrics discarding all measurements. It is used if
+// Resolver.Metrics is nil.
+type NopMetrics struct{}
+
+func (NopMetrics) IncHit()                            {}
+func (NopMetrics) IncMiss()                           {}
+func (NopMetrics) ObserveLookup(time.Duration, error) {}
+func (NopMetrics) SetCacheSize(int)                   {}
+
+// metrics returns the Metrics of the resolver.
+func (r *Resolver) metrics() Metrics {
+	if r.Metrics != nil {
+		return r.Metrics
+	}
+	return NopMetrics{}
+}
+
+// reportSize sends the number of cache entries to the Metrics, if any. No
+// shard lock may be held.
+func (r *Resolver) reportSize() {
+	if r.Metrics != nil {
+		r.Metrics.SetCacheSize(r.Len())
+	}
+}
@@ -0,0 +1,88 @@
+package dnscache
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMetrics is a Metrics recording the measurements it receives.
+type fakeMetrics struct {
+	mu      sync.Mutex
+	hits    int
+	misses  int
+	lookups []time.Duration
+	errs    []error
+	sizes   []int
+}
+
+func (m *fakeMetrics) IncHit() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hits++
+}
+
+func (m *fakeMetrics) IncMiss() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.misses++
+}
+
+func (m *fakeMetrics) ObserveLookup(d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lookups = append(m.lookups, d)
+	m.errs = append(m.errs, err)
+}
+
+func (m *fakeMetrics) SetCacheSize(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sizes = append(m.sizes, n)
+}
+
+func TestResolver_Metrics(t *testing.T) {
+	f := &fakeResolver{
+		hosts: map[string][]string{"example.com": {"10.0.0.1"}},
+		delay: 10 * time.Millisecond,
+	}
+	m := &fakeMetrics{}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.Metrics = m
+
+	r.LookupHost(context.Background(), "example.com")
+	r.LookupHost(context.Background(), "example.com")
+	f.setErr(errLookup)
+	r.LookupHost(context.Background(), "example.org")
+	r.HealthCheck(context.Background(), "example.com")
+	r.RemoveAddr("example.com")
+	r.Remove("example.com")
+	r.Clear()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.hits != 1 || m.misses != 2 {
+		t.Errorf("got %d hits and %d misses, want 1 and 2", m.hits, m.misses)
+	}
+	if len(m.lookups) != 3 {
+		t.Fatalf("got %d lookup observations, want 3", len(m.lookups))
+	}
+	if m.lookups[0] < f.delay {
+		t.Errorf("got lookup latency %v, want at least %v", m.lookups[0], f.delay)
+	}
+	if m.errs[0] != nil || m.errs[1] != errLookup || m.errs[2] != errLookup {
+		t.Errorf("got lookup errors %v, want [<nil> %v %v]", m.errs, errLookup, errLookup)
+	}
+	want := []int{1, 2, 1, 0}
+	if len(m.sizes) != len(want) {
+		t.Fatalf("got sizes %v, want %v", m.sizes, want)
+	}
+	for i := range want {
+		if m.sizes[i] != want[i] {
+			t.Errorf("got sizes %v, want %v", m.sizes, want)
+			break
+		}
+	}
+}
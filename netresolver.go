@@ -0,0 +1,249 @@
+package dnscache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DNS message constants used by the in-memory DNS server of AsNetResolver.
+const (
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeFormErr  = 1
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+)
+
+// errMalformedQuery is returned when a DNS query cannot be parsed.
+var errMalformedQuery = errors.New("dnscache: malformed DNS query")
+
+// AsNetResolver returns a *net.Resolver answering host and reverse lookups
+// from the cache, for libraries only accepting the standard library type.
+// It uses the pure Go resolver of the net package with a Dial function
+// connecting it to an in-memory DNS server backed by LookupHost and
+// LookupAddr, so no DNS query leaves the process.
+//
+// The net package still applies its own configuration: /etc/hosts is
+// consulted first and the search domains of /etc/resolv.conf are appended to
+// relative names. Only A, AAAA and PTR queries are answered; the other
+// lookups, such as LookupMX, fail.
+func (r *Resolver) AsNetResolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go r.serveDNS(ctx, server)
+			return client, nil
+		},
+	}
+}
+
+// serveDNS answers the DNS queries read from conn, framed as over TCP, until
+// conn is closed.
+func (r *Resolver) serveDNS(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		resp := r.answerDNS(ctx, query)
+		if resp == nil {
+			return
+		}
+		out := make([]byte, 2, 2+len(resp))
+		binary.BigEndian.PutUint16(out, uint16(len(resp)))
+		if _, err := conn.Write(append(out, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// answerDNS returns the response to the DNS message query, or nil if query
+// is too short to be answered at all.
+func (r *Resolver) answerDNS(ctx context.Context, query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	name, qtype, qclass, end, err := parseQuestion(query)
+	if err != nil {
+		return dnsResponse(query, 12, dnsRcodeFormErr, nil)
+	}
+	if qclass != dnsClassIN {
+		return dnsResponse(query, end, dnsRcodeNotImp, nil)
+	}
+	var answers [][]byte
+	switch qtype {
+	case dnsTypeA, dnsTypeAAAA:
+		addrs, err := r.LookupHost(ctx, strings.TrimSuffix(name, "."))
+		if err != nil {
+			return dnsResponse(query, end, errRcode(err), nil)
+		}
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				continue
+			}
+			if ip4 := ip.To4(); ip4 != nil && qtype == dnsTypeA {
+				answers = append(answers, dnsAnswer(qtype, ip4))
+			} else if ip4 == nil && qtype == dnsTypeAAAA {
+				answers = append(answers, dnsAnswer(qtype, ip.To16()))
+			}
+		}
+	case dnsTypePTR:
+		addr, ok := reverseIP(name)
+		if !ok {
+			return dnsResponse(query, end, dnsRcodeNXDomain, nil)
+		}
+		names, err := r.LookupAddr(ctx, addr)
+		if err != nil {
+			return dnsResponse(query, end, errRcode(err), nil)
+		}
+		for _, n := range names {
+			if rdata, ok := encodeName(n); ok {
+				answers = append(answers, dnsAnswer(qtype, rdata))
+			}
+		}
+	default:
+		return dnsResponse(query, end, dnsRcodeNotImp, nil)
+	}
+	return dnsResponse(query, end, dnsRcodeSuccess, answers)
+}
+
+// errRcode returns the response code reporting a lookup error.
+func errRcode(err error) int {
+	if isNotFound(err) || errors.Is(err, ErrInvalidName) {
+		return dnsRcodeNXDomain
+	}
+	return dnsRcodeServFail
+}
+
+// parseQuestion parses the single question of query, returning its name,
+// type and class and the offset of its end.
+func parseQuestion(query []byte) (name string, qtype, qclass uint16, end int, err error) {
+	if binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return "", 0, 0, 0, errMalformedQuery
+	}
+	var labels []string
+	off := 12
+	for {
+		if off >= len(query) {
+			return "", 0, 0, 0, errMalformedQuery
+		}
+		n := int(query[off])
+		off++
+		if n == 0 {
+			break
+		}
+		if n > 63 || off+n > len(query) {
+			return "", 0, 0, 0, errMalformedQuery
+		}
+		labels = append(labels, string(query[off:off+n]))
+		off += n
+	}
+	if off+4 > len(query) {
+		return "", 0, 0, 0, errMalformedQuery
+	}
+	qtype = binary.BigEndian.Uint16(query[off:])
+	qclass = binary.BigEndian.Uint16(query[off+2:])
+	return strings.Join(labels, ".") + ".", qtype, qclass, off + 4, nil
+}
+
+// dnsResponse builds the response to query, whose question ends at end,
+// with the given response code and answer records.
+func dnsResponse(query []byte, end, rcode int, answers [][]byte) []byte {
+	resp := make([]byte, 12, end+16*len(answers))
+	copy(resp, query[:2])
+	// QR and RA set, opcode and RD copied from the query.
+	flags := 0x8080 | binary.BigEndian.Uint16(query[2:4])&0x7900 | uint16(rcode)
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	if end > 12 {
+		binary.BigEndian.PutUint16(resp[4:], 1)
+		resp = append(resp, query[12:end]...)
+	}
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+	for _, answer := range answers {
+		resp = append(resp, answer...)
+	}
+	return resp
+}
+
+// dnsAnswer returns an answer record of type qtype for the question name,
+// referenced by a compression pointer, holding rdata.
+func dnsAnswer(qtype uint16, rdata []byte) []byte {
+	rr := make([]byte, 12, 12+len(rdata))
+	binary.BigEndian.PutUint16(rr, 0xc00c)
+	binary.BigEndian.PutUint16(rr[2:], qtype)
+	binary.BigEndian.PutUint16(rr[4:], dnsClassIN)
+	// The TTL, rr[6:10], is left at 0 as answers are served from the cache.
+	binary.BigEndian.PutUint16(rr[10:], uint16(len(rdata)))
+	return append(rr, rdata...)
+}
+
+// encodeName returns name in DNS wire format.
+func encodeName(name string) ([]byte, bool) {
+	name = strings.TrimSuffix(name, ".")
+	var b []byte
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > 63 {
+				return nil, false
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), true
+}
+
+// reverseIP returns the IP address of a reverse lookup name under in-addr.arpa
+// or ip6.arpa.
+func reverseIP(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return "", false
+		}
+		ip := make(net.IP, 4)
+		for i, label := range labels {
+			n, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return "", false
+			}
+			ip[3-i] = byte(n)
+		}
+		return ip.String(), true
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(labels) != 32 {
+			return "", false
+		}
+		ip := make(net.IP, 16)
+		for i, label := range labels {
+			n, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return "", false
+			}
+			j := 31 - i
+			ip[j/2] |= byte(n) << (4 * uint(1-j%2))
+		}
+		return ip.String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,56 @@
+package dnscache
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestResolver_AsNetResolver(t *testing.T) {
+	f := &fakeResolver{
+		hosts: map[string][]string{"example.com": {"192.0.2.1", "2001:db8::1"}},
+		addrs: map[string][]string{
+			"192.0.2.1":   {"example.com."},
+			"2001:db8::1": {"v6.example.com."},
+		},
+	}
+	r := NewDNSResolver(10)
+	r.Resolver = f
+	ctx := context.Background()
+	if _, err := r.LookupHost(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	nr := r.AsNetResolver()
+	// The trailing dot keeps the search domains of the host from applying.
+	addrs, err := nr.LookupHost(ctx, "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(addrs)
+	if want := []string{"192.0.2.1", "2001:db8::1"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("got %v, want %v", addrs, want)
+	}
+	if got := f.callCount(); got != 1 {
+		t.Errorf("got %d upstream calls, want the bridge to hit the cache", got)
+	}
+
+	for addr, want := range map[string][]string{
+		"192.0.2.1":   {"example.com."},
+		"2001:db8::1": {"v6.example.com."},
+	} {
+		names, err := nr.LookupAddr(ctx, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("LookupAddr(%q) = %v, want %v", addr, names, want)
+		}
+	}
+
+	f.setErr(errLookup)
+	if _, err := nr.LookupHost(ctx, "missing.example.com."); !isNotFound(err) {
+		t.Errorf("got error %v, want not found", err)
+	}
+}
@@ -0,0 +1,154 @@
+package dnscache
+
+import (
+	"errors"
+	"time"
+)
+
+// defaultCacheSize is the cache size used by New when WithCacheSize is not
+// provided, and by zero-value Resolvers.
+const defaultCacheSize = 1000
+
+// Option configures a Resolver created with New.
+type Option func(r *Resolver) error
+
+// WithCacheSize sets the maximum number of entries held in the cache.
+func WithCacheSize(size int) Option {
+	return func(r *Resolver) error {
+		if size <= 0 {
+			return errors.New("dnscache: cache size must be positive")
+		}
+		r.cacheSize = size
+		return nil
+	}
+}
+
+// WithCache sets the backend storing cache entries. The cache size and
+// number of shards set with WithCacheSize and WithShards are ignored.
+//
+// Several Resolvers may share the same cache, e.g. to use different timeouts
+// without duplicating entries: each sees the entries stored by the others.
+// The cache must then be safe for concurrent use on its own, as each
+// Resolver only serializes its own accesses to it. Entries are never
+// modified once stored, so sharing them is safe. Concurrent lookups of the
+// same key through different Resolvers are not merged.
+func WithCache(cache Cache) Option {
+	return func(r *Resolver) error {
+		if cache == nil {
+			return errors.New("dnscache: cache must not be nil")
+		}
+		r.shards = []*shard{{cache: cache}}
+		return nil
+	}
+}
+
+// WithAddrCacheSize keeps reverse lookups in a separate cache holding up to
+// size entries, so they do not evict the entries of forward lookups and vice
+// versa. The size set with WithCacheSize or the cache set with WithCache then
+// only holds host and other record lookups. By default, a single cache holds
+// all lookups.
+func WithAddrCacheSize(size int) Option {
+	return func(r *Resolver) error {
+		if size <= 0 {
+			return errors.New("dnscache: address cache size must be positive")
+		}
+		r.addrCacheSize = size
+		return nil
+	}
+}
+
+// maxBytesCacheSize is the number of entries of the cache used by New when
+// WithMaxBytes is given without WithCacheSize.
+const maxBytesCacheSize = 1 << 30
+
+// WithMaxBytes bounds the cache by the estimated size of its entries rather
+// than by their number: once it exceeds maxBytes, the least recently used
+// entries are evicted. The size of an entry is estimated from the lengths of
+// its subject and records plus a fixed overhead, so large results take more
+// room than small ones. The number of entries is only bounded if
+// WithCacheSize is also given. The cap is split among the shards and does
+// not apply to caches set with WithCache.
+func WithMaxBytes(maxBytes int) Option {
+	return func(r *Resolver) error {
+		if maxBytes <= 0 {
+			return errors.New("dnscache: max bytes must be positive")
+		}
+		r.maxBytes = maxBytes
+		return nil
+	}
+}
+
+// WithEvictionPolicy sets the policy selecting the entries evicted from a full
+// cache. The default is LRU. It is ignored if WithCache is given.
+func WithEvictionPolicy(policy EvictionPolicy) Option {
+	return func(r *Resolver) error {
+		if policy != LRU && policy != LFU {
+			return errors.New("dnscache: unknown eviction policy")
+		}
+		r.evictionPolicy = policy
+		return nil
+	}
+}
+
+// WithShards sets the number of independently locked shards the cache is
+// split in. Each shard holds an equal part of the cache size and evicts its
+// own least recently used entries.
+func WithShards(n int) Option {
+	return func(r *Resolver) error {
+		if n <= 0 {
+			return errors.New("dnscache: number of shards must be positive")
+		}
+		r.numShards = n
+		return nil
+	}
+}
+
+// WithTimeout sets the maximum allowed time allowed for a lookup.
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *Resolver) error {
+		if timeout < 0 {
+			return errors.New("dnscache: timeout must not be negative")
+		}
+		r.Timeout = timeout
+		return nil
+	}
+}
+
+// WithResolver sets the resolver used to perform actual DNS lookups.
+func WithResolver(resolver DNSResolver) Option {
+	return func(r *Resolver) error {
+		if resolver == nil {
+			return errors.New("dnscache: resolver must not be nil")
+		}
+		r.Resolver = resolver
+		return nil
+	}
+}
+
+// WithOnCacheMiss sets the function executed on cache misses.
+func WithOnCacheMiss(fn func()) Option {
+	return func(r *Resolver) error {
+		r.OnCacheMiss = fn
+		return nil
+	}
+}
+
+// WithOnCacheHit sets the function executed on cache hits.
+func WithOnCacheHit(fn func()) Option {
+	return func(r *Resolver) error {
+		r.OnCacheHit = fn
+		return nil
+	}
+}
+
+// WithClock sets the Clock used for entry expiries and timestamps, e.g. a
+// fake clock advanced manually in tests. By default, time.Now is used.
+func WithClock(clock Clock) Option {
+	return func(r *Resolver) error {
+		if clock == nil {
+			return errors.New("dnscache: clock must not be nil")
+		}
+		r.clock = clock
+		return nil
+	}
+}
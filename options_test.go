@@ -0,0 +1,109 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"1.2.3.4"}}}
+	var misses int
+	r, err := New(
+		WithCacheSize(1),
+		WithTimeout(time.Second),
+		WithResolver(f),
+		WithOnCacheMiss(func() { misses++ }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Timeout != time.Second {
+		t.Errorf("got timeout %v, want 1s", r.Timeout)
+	}
+	r.LookupHost(context.Background(), "example.com")
+	r.LookupHost(context.Background(), "example.com")
+	if misses != 1 {
+		t.Errorf("got %d misses, want 1", misses)
+	}
+	if f.callCount() != 1 {
+		t.Errorf("got %d upstream calls, want 1", f.callCount())
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	clock := newFakeClock()
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"1.2.3.4"}}}
+	r, err := New(WithResolver(f), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.TTL = time.Hour
+
+	r.LookupHost(context.Background(), "example.com")
+	clock.Advance(59 * time.Minute)
+	r.LookupHost(context.Background(), "example.com")
+	if f.callCount() != 1 {
+		t.Errorf("got %d upstream calls before the TTL, want 1", f.callCount())
+	}
+	clock.Advance(time.Minute)
+	r.LookupHost(context.Background(), "example.com")
+	if f.callCount() != 2 {
+		t.Errorf("got %d upstream calls after the TTL, want 2", f.callCount())
+	}
+}
+
+func TestNew_InvalidOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+	}{
+		{"zero cache size", WithCacheSize(0)},
+		{"negative cache size", WithCacheSize(-1)},
+		{"negative timeout", WithTimeout(-time.Second)},
+		{"nil resolver", WithResolver(nil)},
+		{"nil clock", WithClock(nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if r, err := New(tt.opt); err == nil || r != nil {
+				t.Errorf("got (%v, %v), want an error", r, err)
+			}
+		})
+	}
+}
+
+func TestNewDNSResolver_InvalidSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		r := NewDNSResolver(size)
+		if r == nil {
+			t.Fatalf("NewDNSResolver(%d) returned nil", size)
+		}
+		r.Resolver = &fakeResolver{hosts: map[string][]string{"example.com": {"1.2.3.4"}}}
+		if _, err := r.LookupHost(context.Background(), "example.com"); err != nil {
+			t.Errorf("NewDNSResolver(%d): got %v", size, err)
+		}
+		if r.Len() != 1 {
+			t.Errorf("NewDNSResolver(%d): got %d entries, want 1", size, r.Len())
+		}
+	}
+}
+
+func TestResolver_EffectiveResolver(t *testing.T) {
+	r, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.EffectiveResolver(); got != net.DefaultResolver {
+		t.Errorf("got %v, want net.DefaultResolver", got)
+	}
+	f := &fakeResolver{}
+	r, err = New(WithResolver(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.EffectiveResolver(); got != f {
+		t.Errorf("got %v, want the injected resolver", got)
+	}
+}
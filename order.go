@@ -0,0 +1,106 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+)
+
+// AddressFamily is a preference for the address family of resolved host
+// addresses.
+type AddressFamily int
+
+const (
+	// AnyFamily keeps addresses in the order returned by the upstream
+	// resolver.
+	AnyFamily AddressFamily = iota
+	// PreferIPv4 returns IPv4 addresses before IPv6 addresses.
+	PreferIPv4
+	// PreferIPv6 returns IPv6 addresses before IPv4 addresses.
+	PreferIPv6
+	// IPv4Only returns IPv4 addresses only.
+	IPv4Only
+	// IPv6Only returns IPv6 addresses only.
+	IPv6Only
+)
+
+// orderAddrs applies ShuffleAddresses and AddressFamily to the addresses of
+// host. The returned slice is a copy if addrs had to be reordered or
+// filtered. With IPv4Only or IPv6Only, an error is returned if no address of
+// the requested family is left.
+func (r *Resolver) orderAddrs(host string, addrs []string) ([]string, error) {
+	if r.ShuffleAddresses && len(addrs) > 1 {
+		addrs = r.shuffle(addrs)
+	}
+	switch r.AddressFamily {
+	case PreferIPv4:
+		addrs = sortFamily(addrs, true)
+	case PreferIPv6:
+		addrs = sortFamily(addrs, false)
+	case IPv4Only, IPv6Only:
+		filtered := filterFamily(addrs, r.AddressFamily == IPv4Only)
+		if len(filtered) == 0 && len(addrs) > 0 {
+			return nil, &net.DNSError{Err: "no suitable address found", Name: host}
+		}
+		addrs = filtered
+	}
+	return addrs, nil
+}
+
+// shuffle returns a randomly ordered copy of addrs.
+func (r *Resolver) shuffle(addrs []string) []string {
+	shuffled := make([]string, len(addrs))
+	copy(shuffled, addrs)
+	r.randShuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled
+}
+
+// sortFamily returns a copy of addrs with the addresses of the preferred
+// family first, keeping the relative order within each family.
+func sortFamily(addrs []string, ip4First bool) []string {
+	sorted := make([]string, 0, len(addrs))
+	sorted = append(sorted, filterFamily(addrs, ip4First)...)
+	return append(sorted, filterFamily(addrs, !ip4First)...)
+}
+
+// filterFamily returns the IPv4 addresses of addrs if ip4 is true, the IPv6
+// addresses otherwise.
+func filterFamily(addrs []string, ip4 bool) []string {
+	filtered := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if isIP4(addr) == ip4 {
+			filtered = append(filtered, addr)
+		}
+	}
+	return filtered
+}
+
+// isIP4 reports whether addr is an IPv4 address.
+func isIP4(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() != nil
+}
+
+// LookupHostFamily is like LookupHost, only returning the addresses of the
+// given family: "ip4" for IPv4, "ip6" for IPv6 or "ip" for both. The family
+// is filtered out of the cached addresses, so a host cached with both
+// families is not looked up again, e.g. to fall back to IPv4 after an IPv6
+// connection failed. An error is returned if no address of the family is
+// left.
+func (r *Resolver) LookupHostFamily(ctx context.Context, host, family string) ([]string, error) {
+	switch family {
+	case "ip", "ip4", "ip6":
+	default:
+		return nil, net.UnknownNetworkError(family)
+	}
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil || family == "ip" {
+		return addrs, err
+	}
+	filtered := filterFamily(addrs, family == "ip4")
+	if len(filtered) == 0 && len(addrs) > 0 {
+		return nil, &net.DNSError{Err: "no suitable address found", Name: host}
+	}
+	return filtered, nil
+}
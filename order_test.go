@@ -0,0 +1,80 @@
+package dnscache
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestResolver_AddressFamily(t *testing.T) {
+	mixed := []string{"2001:db8::1", "1.1.1.1", "2001:db8::2", "2.2.2.2"}
+	tests := []struct {
+		name    string
+		family  AddressFamily
+		addrs   []string
+		want    []string
+		wantErr bool
+	}{
+		{"any", AnyFamily, mixed, mixed, false},
+		{"prefer IPv4", PreferIPv4, mixed, []string{"1.1.1.1", "2.2.2.2", "2001:db8::1", "2001:db8::2"}, false},
+		{"prefer IPv6", PreferIPv6, mixed, []string{"2001:db8::1", "2001:db8::2", "1.1.1.1", "2.2.2.2"}, false},
+		{"IPv4 only", IPv4Only, mixed, []string{"1.1.1.1", "2.2.2.2"}, false},
+		{"IPv6 only", IPv6Only, mixed, []string{"2001:db8::1", "2001:db8::2"}, false},
+		{"IPv4 only without IPv4", IPv4Only, []string{"2001:db8::1"}, nil, true},
+		{"IPv6 only without IPv6", IPv6Only, []string{"1.1.1.1"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeResolver{hosts: map[string][]string{"example.com": tt.addrs}}
+			r := NewDNSResolver(128)
+			r.Resolver = f
+			r.AddressFamily = tt.family
+
+			addrs, err := r.LookupHost(context.Background(), "example.com")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(addrs, tt.want) {
+				t.Errorf("got %v, want %v", addrs, tt.want)
+			}
+			r.AddressFamily = AnyFamily
+			if cached, _ := r.LookupHost(context.Background(), "example.com"); !reflect.DeepEqual(cached, tt.addrs) {
+				t.Errorf("cached addresses were modified: %v", cached)
+			}
+		})
+	}
+}
+
+func TestResolver_LookupHostFamily(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"2001:db8::1", "192.0.2.1", "192.0.2.2"}}}
+	r := NewDNSResolver(10)
+	r.Resolver = f
+	ctx := context.Background()
+
+	if _, err := r.LookupHost(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		family string
+		want   []string
+	}{
+		{"ip4", []string{"192.0.2.1", "192.0.2.2"}},
+		{"ip6", []string{"2001:db8::1"}},
+		{"ip", []string{"2001:db8::1", "192.0.2.1", "192.0.2.2"}},
+	}
+	for _, tt := range tests {
+		got, err := r.LookupHostFamily(ctx, "example.com", tt.family)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("LookupHostFamily(%q) = %v, want %v", tt.family, got, tt.want)
+		}
+	}
+	if got := f.callCount(); got != 1 {
+		t.Errorf("got %d upstream calls, want 1", got)
+	}
+	if _, err := r.LookupHostFamily(ctx, "example.com", "tcp"); err == nil {
+		t.Error("got nil error for an unknown family")
+	}
+}
@@ -0,0 +1,197 @@
+package dnscache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// savedEntry is the serialized form of a cache entry.
+type savedEntry struct {
+	Kind    string          `json:"kind"`
+	Subject string          `json:"subject"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	// Negative marks a failed lookup. The error itself is not saved, only
+	// whether it is a not found error.
+	Negative bool       `json:"negative,omitempty"`
+	NotFound bool       `json:"not_found,omitempty"`
+	Expire   *time.Time `json:"expire,omitempty"`
+	// StoredAt is the time the entry was looked up. It is only written to
+	// the WAL.
+	StoredAt *time.Time `json:"stored_at,omitempty"`
+}
+
+// savedSRV is the serialized form of a srvResult.
+type savedSRV struct {
+	CNAME string     `json:"cname"`
+	Addrs []*net.SRV `json:"addrs"`
+}
+
+// Save writes the cache entries to w as JSON, from oldest to newest. Failed
+// lookups are saved as negative entries without their error.
+func (r *Resolver) Save(w io.Writer) error {
+	var entries []savedEntry
+	for _, s := range r.getShards() {
+		var err error
+		s.mu.RLock()
+		entries, err = s.save(entries)
+		s.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	if entries == nil {
+		entries = []savedEntry{}
+	}
+	return json.NewEncoder(w).Encode(entries)
+}
+
+// save appends the entries of the shard to entries. The shard lock must be
+// held.
+func (s *shard) save(entries []savedEntry) ([]savedEntry, error) {
+	for _, key := range s.cache.Keys() {
+		v, found := s.peek(key.(cacheKey))
+		if !found {
+			continue
+		}
+		se, err := newSavedEntry(key.(cacheKey), v.(*cacheEntry))
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, se)
+	}
+	return entries, nil
+}
+
+// newSavedEntry returns the serialized form of the entry e stored for key.
+func newSavedEntry(key cacheKey, e *cacheEntry) (savedEntry, error) {
+	se := savedEntry{
+		Kind:     string(key.kind),
+		Subject:  key.subject,
+		Negative: e.err != nil,
+		NotFound: isNotFound(e.err),
+	}
+	if !e.expire.IsZero() {
+		expire := e.expire
+		se.Expire = &expire
+	}
+	if e.err == nil {
+		val := e.val
+		if res, ok := val.(srvResult); ok {
+			val = savedSRV{CNAME: res.cname, Addrs: res.addrs}
+		}
+		b, err := json.Marshal(val)
+		if err != nil {
+			return se, err
+		}
+		se.Value = b
+	}
+	return se, nil
+}
+
+// Load reads cache entries written by Save from rd and adds them to the cache.
+// Expired entries are skipped. Negative entries are restored with a generic
+// *net.DNSError, reporting IsNotFound for not found errors.
+func (r *Resolver) Load(rd io.Reader) error {
+	var entries []savedEntry
+	if err := json.NewDecoder(rd).Decode(&entries); err != nil {
+		return err
+	}
+	defer r.reportSize()
+	now := r.getNow()
+	for _, se := range entries {
+		if err := r.restore(se, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// savedKind returns the kind of a saved entry, checking it is one of the
+// Kind constants so that no entry the Resolver cannot look up is restored.
+func savedKind(kind string) (byte, error) {
+	if len(kind) == 1 {
+		switch kind[0] {
+		case KindHost, KindAddr, KindCNAME, KindMX, KindTXT, KindNS, KindSRV, KindPort:
+			return kind[0], nil
+		}
+	}
+	return 0, fmt.Errorf("dnscache: invalid saved entry kind %q", kind)
+}
+
+// restore adds the saved entry se to the cache unless it expired at now.
+func (r *Resolver) restore(se savedEntry, now time.Time) error {
+	kind, err := savedKind(se.Kind)
+	if err != nil {
+		return err
+	}
+	e := &cacheEntry{storedAt: now}
+	if se.StoredAt != nil {
+		e.storedAt = *se.StoredAt
+	}
+	if se.Expire != nil {
+		if !now.Before(*se.Expire) {
+			return nil
+		}
+		e.expire = *se.Expire
+	}
+	key := cacheKey{kind: kind, subject: se.Subject}
+	if se.Negative {
+		e.err = &net.DNSError{Err: "lookup failure restored from cache", Name: se.Subject}
+		if se.NotFound {
+			e.err = &net.DNSError{Err: "no such host", Name: se.Subject, IsNotFound: true}
+		}
+		e.err = lightError(e.err)
+	} else {
+		val, err := decodeValue(key.kind, se.Value)
+		if err != nil {
+			return err
+		}
+		e.val = val
+	}
+	s := r.shard(key)
+	s.mu.Lock()
+	evicted := s.add(key, e)
+	keys := s.takeEvicted()
+	s.mu.Unlock()
+	if evicted > 0 {
+		atomic.AddUint64(&r.stats.Evictions, uint64(evicted))
+	}
+	r.notifyEvicted(keys)
+	return nil
+}
+
+// decodeValue decodes the saved value of an entry of the given kind.
+func decodeValue(kind byte, b json.RawMessage) (interface{}, error) {
+	var err error
+	switch kind {
+	case KindHost, KindAddr, KindTXT:
+		var v []string
+		err = json.Unmarshal(b, &v)
+		return v, err
+	case KindCNAME:
+		var v string
+		err = json.Unmarshal(b, &v)
+		return v, err
+	case KindMX:
+		var v []*net.MX
+		err = json.Unmarshal(b, &v)
+		return v, err
+	case KindNS:
+		var v []*net.NS
+		err = json.Unmarshal(b, &v)
+		return v, err
+	case KindSRV:
+		var v savedSRV
+		err = json.Unmarshal(b, &v)
+		return srvResult{cname: v.CNAME, addrs: v.Addrs}, err
+	case KindPort:
+		var v int
+		err = json.Unmarshal(b, &v)
+		return v, err
+	}
+	return nil, fmt.Errorf("dnscache: invalid saved entry kind %q", kind)
+}
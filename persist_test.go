@@ -0,0 +1,87 @@
+package dnscache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResolver_SaveLoad(t *testing.T) {
+	clock := newFakeClock()
+	f := &fakeResolver{
+		hosts: map[string][]string{"a.com": {"1.1.1.1", "2001:db8::1"}, "b.com": {"2.2.2.2"}},
+		addrs: map[string][]string{"1.1.1.1": {"a.com."}},
+		srvs:  map[string][]*net.SRV{"_sip._tcp.a.com": {{Target: "sip.a.com.", Port: 5060, Priority: 1, Weight: 2}}},
+	}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.TTL = time.Hour
+	r.clock = clock
+	ctx := context.Background()
+	r.LookupHost(ctx, "b.com")
+	clock.Advance(30 * time.Minute)
+	r.LookupHost(ctx, "a.com")
+	r.LookupAddr(ctx, "1.1.1.1")
+	r.LookupSRV(ctx, "sip", "tcp", "a.com")
+	f.setErr(errLookup)
+	r.LookupHost(ctx, "fail.com")
+
+	var buf bytes.Buffer
+	if err := r.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// b.com expires before the cache is loaded back.
+	clock.Advance(45 * time.Minute)
+	f2 := &fakeResolver{}
+	r2 := NewDNSResolver(128)
+	r2.Resolver = f2
+	r2.clock = clock
+	if err := r2.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if r2.Len() != 4 {
+		t.Errorf("got %d entries, want 4", r2.Len())
+	}
+	addrs, err := r2.LookupHost(ctx, "a.com")
+	if err != nil || !reflect.DeepEqual(addrs, f.hosts["a.com"]) {
+		t.Errorf("got (%v, %v), want %v", addrs, err, f.hosts["a.com"])
+	}
+	names, err := r2.LookupAddr(ctx, "1.1.1.1")
+	if err != nil || !reflect.DeepEqual(names, f.addrs["1.1.1.1"]) {
+		t.Errorf("got (%v, %v), want %v", names, err, f.addrs["1.1.1.1"])
+	}
+	cname, srvs, err := r2.LookupSRV(ctx, "sip", "tcp", "a.com")
+	if err != nil || cname != "_sip._tcp.a.com." || !reflect.DeepEqual(srvs, f.srvs["_sip._tcp.a.com"]) {
+		t.Errorf("got (%q, %v, %v), want SRV records", cname, srvs, err)
+	}
+	var dnsErr *net.DNSError
+	if _, err := r2.LookupHost(ctx, "fail.com"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("got %v for restored negative entry, want a not found *net.DNSError", err)
+	}
+	if f2.callCount() != 0 {
+		t.Errorf("got %d upstream calls, want all lookups served from loaded entries", f2.callCount())
+	}
+}
+
+func TestResolver_LoadInvalid(t *testing.T) {
+	r := NewDNSResolver(128)
+	if err := r.Load(bytes.NewBufferString(`[{"kind":"x","subject":"a.com"}]`)); err == nil {
+		t.Error("got nil error for invalid kind")
+	}
+	if err := r.Load(bytes.NewBufferString(`[{"kind":"z","subject":"x","negative":true}]`)); err == nil {
+		t.Error("got nil error for invalid kind of a negative entry")
+	}
+	if r.Len() != 0 {
+		t.Errorf("got %d entries loaded, want 0", r.Len())
+	}
+	// Refreshing must not look up entries of unknown kinds.
+	r.Refresh()
+	if err := r.Load(bytes.NewBufferString(`not json`)); err == nil {
+		t.Error("got nil error for invalid JSON")
+	}
+}
@@ -0,0 +1,26 @@
+package dnscache
+
+import "math/rand"
+
+// int63n returns a random number in [0, n) drawn from Rand or the package
+// default source.
+func (r *Resolver) int63n(n int64) int64 {
+	if r.Rand == nil {
+		return rand.Int63n(n)
+	}
+	r.randMu.Lock()
+	defer r.randMu.Unlock()
+	return r.Rand.Int63n(n)
+}
+
+// randShuffle shuffles n elements with swap using Rand or the package default
+// source.
+func (r *Resolver) randShuffle(n int, swap func(i, j int)) {
+	if r.Rand == nil {
+		rand.Shuffle(n, swap)
+		return
+	}
+	r.randMu.Lock()
+	defer r.randMu.Unlock()
+	r.Rand.Shuffle(n, swap)
+}
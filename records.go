@@ -0,0 +1,309 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MXResolver is implemented by DNSResolvers supporting MX lookups.
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// TXTResolver is implemented by DNSResolvers supporting TXT lookups.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// NSResolver is implemented by DNSResolvers supporting NS lookups.
+type NSResolver interface {
+	LookupNS(ctx context.Context, name string) ([]*net.NS, error)
+}
+
+// SRVResolver is implemented by DNSResolvers supporting SRV lookups.
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+}
+
+// PortResolver is implemented by DNSResolvers supporting service port
+// lookups, such as net.Resolver.
+type PortResolver interface {
+	LookupPort(ctx context.Context, network, service string) (port int, err error)
+}
+
+// srvResult is the cached value of a SRV lookup.
+type srvResult struct {
+	cname string
+	addrs []*net.SRV
+}
+
+// LookupMX returns the DNS MX records for the given domain name sorted by
+// preference. It returns ErrNotSupported if the configured Resolver does not
+// implement MXResolver.
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if _, ok := r.resolver(ctx).(MXResolver); !ok {
+		return nil, ErrNotSupported
+	}
+	val, _, err := r.lookup(ctx, r.key(KindMX, name))
+	mxs, _ := val.([]*net.MX)
+	return mxs, err
+}
+
+// LookupTXT returns the DNS TXT records for the given domain name. It returns
+// ErrNotSupported if the configured Resolver does not implement TXTResolver.
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if _, ok := r.resolver(ctx).(TXTResolver); !ok {
+		return nil, ErrNotSupported
+	}
+	val, _, err := r.lookup(ctx, r.key(KindTXT, name))
+	txts, _ := val.([]string)
+	return txts, err
+}
+
+// LookupNS returns the DNS NS records for the given domain name. It returns
+// ErrNotSupported if the configured Resolver does not implement NSResolver.
+func (r *Resolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	if _, ok := r.resolver(ctx).(NSResolver); !ok {
+		return nil, ErrNotSupported
+	}
+	val, _, err := r.lookup(ctx, r.key(KindNS, name))
+	nss, _ := val.([]*net.NS)
+	return nss, err
+}
+
+// LookupSRV tries to resolve an SRV query of the given service, protocol, and
+// domain name, following the semantics of net.Resolver.LookupSRV. It returns
+// ErrNotSupported if the configured Resolver does not implement SRVResolver.
+func (r *Resolver) LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error) {
+	if _, ok := r.resolver(ctx).(SRVResolver); !ok {
+		return "", nil, ErrNotSupported
+	}
+	val, _, err := r.lookup(ctx, r.key(KindSRV, srvTarget(service, proto, name)))
+	if res, ok := val.(srvResult); ok {
+		cname, addrs = res.cname, res.addrs
+	}
+	return
+}
+
+// LookupSRVSorted is like LookupSRV, ordering the records as described in
+// RFC 2782 on each call: by ascending priority, then randomly within a
+// priority with a probability proportional to their weight. Like the net
+// package, records of weight 0 come after the weighted records of the same
+// priority. The random selection draws from Rand.
+func (r *Resolver) LookupSRVSorted(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error) {
+	cname, addrs, err = r.LookupSRV(ctx, service, proto, name)
+	if err == nil {
+		r.sortSRV(addrs)
+	}
+	return
+}
+
+// LookupService returns the target and port of the first record returned by
+// LookupSRVSorted, e.g. to connect to a service discovered by SRV records.
+// The target is returned as is, usually with a trailing dot.
+func (r *Resolver) LookupService(ctx context.Context, service, proto, name string) (host string, port int, err error) {
+	_, addrs, err := r.LookupSRVSorted(ctx, service, proto, name)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(addrs) == 0 {
+		return "", 0, &net.DNSError{Err: "no SRV records found", Name: srvTarget(service, proto, name), IsNotFound: true}
+	}
+	return addrs[0].Target, int(addrs[0].Port), nil
+}
+
+// LookupPort looks up the port for the given network and service, following
+// the semantics of net.Resolver.LookupPort. It returns ErrNotSupported if the
+// configured Resolver does not implement PortResolver.
+func (r *Resolver) LookupPort(ctx context.Context, network, service string) (port int, err error) {
+	if _, ok := r.resolver(ctx).(PortResolver); !ok {
+		return 0, ErrNotSupported
+	}
+	val, _, err := r.lookup(ctx, r.key(KindPort, network+"/"+service))
+	port, _ = val.(int)
+	return port, err
+}
+
+// sortSRV orders addrs in place by priority and weighted random selection.
+func (r *Resolver) sortSRV(addrs []*net.SRV) {
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return addrs[i].Priority < addrs[j].Priority
+	})
+	for i := 0; i < len(addrs); {
+		j := i + 1
+		for j < len(addrs) && addrs[j].Priority == addrs[i].Priority {
+			j++
+		}
+		r.shuffleByWeight(addrs[i:j])
+		i = j
+	}
+}
+
+// shuffleByWeight orders addrs, all of the same priority, by weighted random
+// selection.
+func (r *Resolver) shuffleByWeight(addrs []*net.SRV) {
+	sum := 0
+	for _, addr := range addrs {
+		sum += int(addr.Weight)
+	}
+	for sum > 0 && len(addrs) > 1 {
+		n := int(r.int63n(int64(sum)))
+		for i := range addrs {
+			n -= int(addrs[i].Weight)
+			if n < 0 {
+				sum -= int(addrs[i].Weight)
+				addrs[0], addrs[i] = addrs[i], addrs[0]
+				break
+			}
+		}
+		addrs = addrs[1:]
+	}
+}
+
+// srvTarget returns the domain name queried for a SRV lookup. Like
+// net.Resolver.LookupSRV, the name is queried directly if both service and
+// proto are empty.
+func srvTarget(service, proto, name string) string {
+	if service == "" && proto == "" {
+		return name
+	}
+	return "_" + service + "._" + proto + "." + name
+}
+
+// recordLookupFunc returns the lookup function for the record kinds defined
+// in this file, or nil if kind is not one of them.
+func (r *Resolver) recordLookupFunc(ctx context.Context, resolver DNSResolver, key cacheKey) func() (interface{}, error) {
+	switch key.kind {
+	case KindMX:
+		return func() (interface{}, error) {
+			mr, ok := resolver.(MXResolver)
+			if !ok {
+				return nil, ErrNotSupported
+			}
+			ctx, cancel := r.getCtx(ctx)
+			defer cancel()
+			return mr.LookupMX(ctx, key.subject)
+		}
+	case KindTXT:
+		return func() (interface{}, error) {
+			tr, ok := resolver.(TXTResolver)
+			if !ok {
+				return nil, ErrNotSupported
+			}
+			ctx, cancel := r.getCtx(ctx)
+			defer cancel()
+			return tr.LookupTXT(ctx, key.subject)
+		}
+	case KindNS:
+		return func() (interface{}, error) {
+			nr, ok := resolver.(NSResolver)
+			if !ok {
+				return nil, ErrNotSupported
+			}
+			ctx, cancel := r.getCtx(ctx)
+			defer cancel()
+			return nr.LookupNS(ctx, key.subject)
+		}
+	case KindSRV:
+		return func() (interface{}, error) {
+			sr, ok := resolver.(SRVResolver)
+			if !ok {
+				return nil, ErrNotSupported
+			}
+			ctx, cancel := r.getCtx(ctx)
+			defer cancel()
+			cname, addrs, err := sr.LookupSRV(ctx, "", "", key.subject)
+			if err != nil {
+				return nil, err
+			}
+			return srvResult{cname: cname, addrs: addrs}, nil
+		}
+	case KindPort:
+		return func() (interface{}, error) {
+			pr, ok := resolver.(PortResolver)
+			if !ok {
+				return nil, ErrNotSupported
+			}
+			ctx, cancel := r.getCtx(ctx)
+			defer cancel()
+			network, service := key.subject, ""
+			if i := strings.IndexByte(key.subject, '/'); i >= 0 {
+				network, service = key.subject[:i], key.subject[i+1:]
+			}
+			return pr.LookupPort(ctx, network, service)
+		}
+	}
+	return nil
+}
+
+// Records holds the records of a domain name returned by LookupAll.
+type Records struct {
+	A    []string
+	AAAA []string
+	MX   []*net.MX
+	TXT  []string
+	NS   []*net.NS
+	// Errs holds the error of each failed lookup, keyed by KindHost,
+	// KindMX, KindTXT or KindNS.
+	Errs map[byte]error
+}
+
+// LookupAll looks up the addresses and the MX, TXT and NS records of name
+// concurrently, each through the cache. Failed lookups, including those not
+// supported by the Resolver, are reported in Records.Errs; an error is only
+// returned, as a MultiError, if all lookups fail.
+func (r *Resolver) LookupAll(ctx context.Context, name string) (Records, error) {
+	var (
+		recs Records
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+	)
+	recs.Errs = map[byte]error{}
+	run := func(kind byte, fn func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := fn()
+			if err != nil {
+				mu.Lock()
+				recs.Errs[kind] = err
+				mu.Unlock()
+			}
+		}()
+	}
+	run(KindHost, func() error {
+		addrs, err := r.LookupHost(ctx, name)
+		for _, addr := range addrs {
+			if isIP4(addr) {
+				recs.A = append(recs.A, addr)
+			} else {
+				recs.AAAA = append(recs.AAAA, addr)
+			}
+		}
+		return err
+	})
+	run(KindMX, func() (err error) {
+		recs.MX, err = r.LookupMX(ctx, name)
+		return
+	})
+	run(KindTXT, func() (err error) {
+		recs.TXT, err = r.LookupTXT(ctx, name)
+		return
+	})
+	run(KindNS, func() (err error) {
+		recs.NS, err = r.LookupNS(ctx, name)
+		return
+	})
+	wg.Wait()
+	if len(recs.Errs) == 4 {
+		errs := make(MultiError, 0, len(recs.Errs))
+		for _, kind := range []byte{KindHost, KindMX, KindTXT, KindNS} {
+			errs = append(errs, recs.Errs[kind])
+		}
+		return recs, errs
+	}
+	return recs, nil
+}
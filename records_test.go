@@ -0,0 +1,253 @@
+package dnscache
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResolver_RecordLookups(t *testing.T) {
+	f := &fakeResolver{
+		mxs:  map[string][]*net.MX{"example.com": {{Host: "mx.example.com.", Pref: 10}}},
+		txts: map[string][]string{"example.com": {"v=spf1 -all"}},
+		nss:  map[string][]*net.NS{"example.com": {{Host: "ns1.example.com."}}},
+		srvs: map[string][]*net.SRV{"_sip._tcp.example.com": {{Target: "sip.example.com.", Port: 5060}}},
+	}
+	tests := []struct {
+		name   string
+		lookup func(r *Resolver) (interface{}, error)
+		want   interface{}
+	}{
+		{"MX", func(r *Resolver) (interface{}, error) {
+			return r.LookupMX(context.Background(), "example.com")
+		}, f.mxs["example.com"]},
+		{"TXT", func(r *Resolver) (interface{}, error) {
+			return r.LookupTXT(context.Background(), "example.com")
+		}, f.txts["example.com"]},
+		{"NS", func(r *Resolver) (interface{}, error) {
+			return r.LookupNS(context.Background(), "example.com")
+		}, f.nss["example.com"]},
+		{"SRV", func(r *Resolver) (interface{}, error) {
+			_, addrs, err := r.LookupSRV(context.Background(), "sip", "tcp", "example.com")
+			return addrs, err
+		}, f.srvs["_sip._tcp.example.com"]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			f.calls = 0
+			r := NewDNSResolver(128)
+			r.Resolver = f
+			r.TTL = time.Minute
+			r.clock = clock
+
+			for _, wantCalls := range []int{1, 1} {
+				got, err := tt.lookup(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+				if f.callCount() != wantCalls {
+					t.Errorf("got %d upstream calls, want %d", f.callCount(), wantCalls)
+				}
+			}
+			clock.Advance(time.Minute)
+			if _, err := tt.lookup(r); err != nil {
+				t.Fatal(err)
+			}
+			if f.callCount() != 2 {
+				t.Errorf("got %d upstream calls after expiry, want 2", f.callCount())
+			}
+		})
+	}
+}
+
+func TestResolver_LookupSRVCNAME(t *testing.T) {
+	f := &fakeResolver{srvs: map[string][]*net.SRV{"_sip._tcp.example.com": {{Target: "sip.example.com."}}}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+
+	cname, _, err := r.LookupSRV(context.Background(), "", "", "_sip._tcp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cname != "_sip._tcp.example.com." {
+		t.Errorf("got cname %q, want _sip._tcp.example.com.", cname)
+	}
+	// Querying the same target through service and proto hits the cache.
+	if _, _, err := r.LookupSRV(context.Background(), "sip", "tcp", "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if f.callCount() != 1 {
+		t.Errorf("got %d upstream calls, want 1", f.callCount())
+	}
+}
+
+func TestResolver_RecordLookupsNotSupported(t *testing.T) {
+	r := NewDNSResolver(128)
+	r.Resolver = &blockingResolver{}
+	ctx := context.Background()
+	if _, err := r.LookupMX(ctx, "example.com"); err != ErrNotSupported {
+		t.Errorf("MX: got %v, want ErrNotSupported", err)
+	}
+	if _, err := r.LookupTXT(ctx, "example.com"); err != ErrNotSupported {
+		t.Errorf("TXT: got %v, want ErrNotSupported", err)
+	}
+	if _, err := r.LookupNS(ctx, "example.com"); err != ErrNotSupported {
+		t.Errorf("NS: got %v, want ErrNotSupported", err)
+	}
+	if _, _, err := r.LookupSRV(ctx, "sip", "tcp", "example.com"); err != ErrNotSupported {
+		t.Errorf("SRV: got %v, want ErrNotSupported", err)
+	}
+}
+
+// txtFailResolver is a fakeResolver failing TXT lookups.
+type txtFailResolver struct {
+	*fakeResolver
+}
+
+func (t txtFailResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, errLookup
+}
+
+func TestResolver_LookupAll(t *testing.T) {
+	f := &fakeResolver{
+		hosts: map[string][]string{"example.com": {"1.2.3.4", "2001:db8::1"}},
+		mxs:   map[string][]*net.MX{"example.com": {{Host: "mx.example.com.", Pref: 10}}},
+		nss:   map[string][]*net.NS{"example.com": {{Host: "ns1.example.com."}}},
+	}
+	r := NewDNSResolver(128)
+	r.Resolver = txtFailResolver{f}
+
+	for i := 0; i < 2; i++ {
+		recs, err := r.LookupAll(context.Background(), "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Records{
+			A:    []string{"1.2.3.4"},
+			AAAA: []string{"2001:db8::1"},
+			MX:   f.mxs["example.com"],
+			NS:   f.nss["example.com"],
+		}
+		if err := recs.Errs[KindTXT]; err == nil || err.Error() != errLookup.Error() || len(recs.Errs) != 1 {
+			t.Errorf("got errors %v, want the TXT lookup error only", recs.Errs)
+		}
+		recs.Errs = nil
+		if !reflect.DeepEqual(recs, want) {
+			t.Errorf("got %+v, want %+v", recs, want)
+		}
+	}
+	if got := f.callCount(); got != 3 {
+		t.Errorf("got %d upstream calls, want 3 as repeated calls use the cache", got)
+	}
+}
+
+func TestResolver_LookupAllFails(t *testing.T) {
+	r := NewDNSResolver(128)
+	r.Resolver = &struct{ DNSResolver }{&fakeResolver{err: errLookup}}
+	recs, err := r.LookupAll(context.Background(), "example.com")
+	errs, ok := err.(MultiError)
+	if !ok || len(errs) != 4 {
+		t.Fatalf("got %v, want a MultiError of 4 errors", err)
+	}
+	if errs[0] != errLookup || recs.Errs[KindMX] != ErrNotSupported {
+		t.Errorf("got errors %v, want the host lookup error and ErrNotSupported", errs)
+	}
+}
+
+func TestResolver_LookupSRVSorted(t *testing.T) {
+	srvs := []*net.SRV{
+		{Target: "backup.", Priority: 20, Weight: 0},
+		{Target: "zero.", Priority: 10, Weight: 0},
+		{Target: "light.", Priority: 10, Weight: 10},
+		{Target: "heavy.", Priority: 10, Weight: 90},
+		{Target: "first.", Priority: 5, Weight: 0},
+	}
+	f := &fakeResolver{srvs: map[string][]*net.SRV{"_sip._tcp.example.com": srvs}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.Rand = rand.New(rand.NewSource(1))
+
+	heavyFirst := 0
+	const n = 1000
+	for i := 0; i < n; i++ {
+		_, addrs, err := r.LookupSRVSorted(context.Background(), "sip", "tcp", "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var targets []string
+		for _, addr := range addrs {
+			targets = append(targets, addr.Target)
+		}
+		if targets[0] != "first." || targets[3] != "zero." || targets[4] != "backup." {
+			t.Fatalf("got order %v, want by priority with zero weight last", targets)
+		}
+		if targets[1] == "heavy." {
+			heavyFirst++
+		}
+	}
+	if heavyFirst < n*8/10 || heavyFirst == n {
+		t.Errorf("heavy record came first %d times out of %d, want about 90%%", heavyFirst, n)
+	}
+	if f.calls != 1 {
+		t.Errorf("got %d upstream calls, want 1", f.calls)
+	}
+	if srvs[0].Target != "backup." {
+		t.Error("upstream records were reordered")
+	}
+}
+
+func TestResolver_LookupService(t *testing.T) {
+	f := &fakeResolver{srvs: map[string][]*net.SRV{
+		"_sip._tcp.example.com": {
+			{Target: "backup.example.com.", Port: 5061, Priority: 20, Weight: 10},
+			{Target: "sip.example.com.", Port: 5060, Priority: 10, Weight: 10},
+		},
+	}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+
+	host, port, err := r.LookupService(context.Background(), "sip", "tcp", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "sip.example.com." || port != 5060 {
+		t.Errorf("got %s:%d, want sip.example.com.:5060", host, port)
+	}
+	if _, _, err := r.LookupService(context.Background(), "xmpp", "tcp", "example.com"); !isNotFound(err) {
+		t.Errorf("got error %v, want not found", err)
+	}
+}
+
+func TestResolver_LookupPort(t *testing.T) {
+	f := &fakeResolver{ports: map[string]int{"tcp/http": 80}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+
+	for i := 0; i < 2; i++ {
+		port, err := r.LookupPort(context.Background(), "tcp", "http")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port != 80 {
+			t.Errorf("got port %d, want 80", port)
+		}
+	}
+	if f.calls != 1 {
+		t.Errorf("got %d upstream calls, want 1", f.calls)
+	}
+	if _, err := r.LookupPort(context.Background(), "tcp", "gopher-nope"); err == nil {
+		t.Error("got nil error for an unknown service")
+	}
+
+	r.Resolver = &blockingResolver{}
+	if _, err := r.LookupPort(context.Background(), "tcp", "http"); err != ErrNotSupported {
+		t.Errorf("got error %v, want ErrNotSupported", err)
+	}
+}
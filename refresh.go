@@ -0,0 +1,84 @@
+package dnscache
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrAutoRefreshStarted is returned by StartAutoRefresh if auto-refresh is
+// already running.
+var ErrAutoRefreshStarted = errors.New("dnscache: auto-refresh already started")
+
+// ErrClosed is returned by lookups and StartAutoRefresh once the Resolver is
+// closed.
+var ErrClosed = errors.New("dnscache: resolver closed")
+
+// StartAutoRefresh starts a goroutine calling Refresh every interval, adjusted
+// by RefreshJitter, until Stop is called. If AutoTune is set, Tune is called
+// after each Refresh. It returns ErrAutoRefreshStarted if
+// auto-refresh is already running.
+func (r *Resolver) StartAutoRefresh(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("dnscache: auto-refresh interval must be positive")
+	}
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+	if r.isClosed() {
+		return ErrClosed
+	}
+	if r.refreshStop != nil {
+		return ErrAutoRefreshStarted
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	r.refreshStop = stop
+	r.refreshDone = done
+	go func() {
+		defer close(done)
+		t := time.NewTimer(r.jitter(interval))
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				r.Refresh()
+				if r.AutoTune {
+					r.Tune()
+				}
+				t.Reset(r.jitter(interval))
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops the auto-refresh goroutine and waits for it to exit. It is safe
+// to call Stop if auto-refresh was never started.
+func (r *Resolver) Stop() {
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+	if r.refreshStop == nil {
+		return
+	}
+	close(r.refreshStop)
+	<-r.refreshDone
+	r.refreshStop = nil
+	r.refreshDone = nil
+}
+
+// Close stops the auto-refresh goroutine, waiting for it to exit, and makes
+// all subsequent lookups fail with ErrClosed without calling the upstream
+// resolver. Lookups in flight are allowed to finish. Closing an already
+// closed Resolver has no effect.
+func (r *Resolver) Close() error {
+	atomic.StoreInt32(&r.closed, 1)
+	r.Stop()
+	return nil
+}
+
+// isClosed reports whether Close was called.
+func (r *Resolver) isClosed() bool {
+	return atomic.LoadInt32(&r.closed) != 0
+}
@@ -0,0 +1,452 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowResolver is a DNSResolver taking delay to answer and recording the
+// maximum number of concurrent lookups it served.
+type slowResolver struct {
+	delay time.Duration
+
+	mu       sync.Mutex
+	inFlight int
+	max      int
+	calls    int
+}
+
+func (s *slowResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	s.mu.Lock()
+	s.calls++
+	s.inFlight++
+	if s.inFlight > s.max {
+		s.max = s.inFlight
+	}
+	s.mu.Unlock()
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	s.inFlight--
+	s.mu.Unlock()
+	return []string{"1.2.3.4"}, nil
+}
+
+func (s *slowResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return s.LookupHost(ctx, addr)
+}
+
+func (s *slowResolver) maxInFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.max
+}
+
+func (s *slowResolver) callCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func TestResolver_AutoRefresh(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"1.2.3.4"}}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.LookupHost(context.Background(), "example.com")
+
+	if err := r.StartAutoRefresh(5 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.StartAutoRefresh(5 * time.Millisecond); err != ErrAutoRefreshStarted {
+		t.Errorf("got %v on second start, want ErrAutoRefreshStarted", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for f.callCount() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("entries were not refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	r.Stop()
+
+	calls := f.callCount()
+	time.Sleep(20 * time.Millisecond)
+	if got := f.callCount(); got != calls {
+		t.Errorf("got %d upstream calls after Stop, want %d", got, calls)
+	}
+	if r.refreshDone != nil {
+		t.Error("refresh goroutine still registered after Stop")
+	}
+}
+
+func TestResolver_StopWithoutStart(t *testing.T) {
+	r := NewDNSResolver(128)
+	r.Stop()
+	r.Stop()
+}
+
+func TestResolver_RefreshConcurrency(t *testing.T) {
+	for _, limit := range []int{0, 1, 3} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			s := &slowResolver{}
+			r := NewDNSResolver(128)
+			r.Resolver = s
+			for i := 0; i < 10; i++ {
+				r.LookupHost(context.Background(), fmt.Sprintf("host%d.com", i))
+			}
+			s.delay = 5 * time.Millisecond
+			r.RefreshConcurrency = limit
+			r.Refresh()
+
+			want := limit
+			if want < 1 {
+				want = 1
+			}
+			if got := s.maxInFlight(); got > want {
+				t.Errorf("got %d concurrent lookups, want at most %d", got, want)
+			}
+			if got := s.callCount(); got != 20 {
+				t.Errorf("got %d upstream calls, want 20", got)
+			}
+		})
+	}
+}
+
+func TestResolver_RefreshJitter(t *testing.T) {
+	clock := newFakeClock()
+	r := NewDNSResolver(1000)
+	r.Resolver = &fakeResolver{}
+	r.TTL = time.Minute
+	r.RefreshJitter = 10 * time.Second
+	r.clock = clock
+	for i := 0; i < 200; i++ {
+		r.LookupHost(context.Background(), fmt.Sprintf("host%d.com", i))
+	}
+
+	min, max := clock.Now().Add(time.Hour), time.Time{}
+	expiries := map[time.Time]bool{}
+	for _, key := range r.keys() {
+		v, _ := r.shard(key).cache.Get(key)
+		expire := v.(*cacheEntry).expire
+		expiries[expire] = true
+		if expire.Before(min) {
+			min = expire
+		}
+		if expire.After(max) {
+			max = expire
+		}
+	}
+	base := clock.Now().Add(time.Minute)
+	if min.Before(base.Add(-10*time.Second)) || max.After(base.Add(10*time.Second)) {
+		t.Errorf("expiries spread over [%v, %v], want within 10s of %v", min, max, base)
+	}
+	if len(expiries) < 100 {
+		t.Errorf("got %d distinct expiries for 200 entries, want them spread", len(expiries))
+	}
+	if max.Sub(min) < 10*time.Second {
+		t.Errorf("expiries spread over %v, want most of the 20s jitter window", max.Sub(min))
+	}
+}
+
+func TestResolver_RefreshJitterClamped(t *testing.T) {
+	clock := newFakeClock()
+	r := NewDNSResolver(1000)
+	r.Resolver = &fakeResolver{}
+	r.TTL = time.Hour
+	r.MinTTL = 55 * time.Minute
+	r.MaxTTL = time.Hour
+	r.RefreshJitter = 10 * time.Minute
+	r.clock = clock
+	for i := 0; i < 200; i++ {
+		r.LookupHost(context.Background(), fmt.Sprintf("host%d.com", i))
+	}
+	for _, key := range r.keys() {
+		v, _ := r.shard(key).cache.Get(key)
+		ttl := v.(*cacheEntry).expire.Sub(clock.Now())
+		if ttl < r.MinTTL || ttl > r.MaxTTL {
+			t.Fatalf("got TTL %v for %s, want within [%v, %v]", ttl, key.subject, r.MinTTL, r.MaxTTL)
+		}
+	}
+}
+
+func TestResolver_MaxConcurrentLookups(t *testing.T) {
+	s := &slowResolver{delay: 5 * time.Millisecond}
+	r := NewDNSResolver(128)
+	r.Resolver = s
+	r.MaxConcurrentLookups = 3
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r.LookupHost(context.Background(), fmt.Sprintf("host%d.com", i))
+		}(i)
+	}
+	wg.Wait()
+	if got := s.maxInFlight(); got > 3 {
+		t.Errorf("got %d concurrent lookups, want at most 3", got)
+	}
+	if got := s.callCount(); got != 20 {
+		t.Errorf("got %d upstream calls, want 20", got)
+	}
+}
+
+func TestResolver_MaxConcurrentLookupsContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{}, 1)
+	r := NewDNSResolver(128)
+	r.Resolver = &blockingResolver{release: release, started: started}
+	r.MaxConcurrentLookups = 1
+	go r.LookupHost(context.Background(), "a.com")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := r.LookupHost(ctx, "b.com"); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want context.DeadlineExceeded while waiting for a slot", err)
+	}
+}
+
+func TestResolver_RefreshRacesLookups(t *testing.T) {
+	hosts := map[string][]string{}
+	for i := 0; i < 8; i++ {
+		hosts[fmt.Sprintf("host%d.com", i)] = []string{fmt.Sprintf("10.0.0.%d", i)}
+	}
+	f := &fakeResolver{hosts: hosts}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.ServeStale = true
+	r.TransientErrorTTL = time.Millisecond
+	r.RefreshConcurrency = 4
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				host := fmt.Sprintf("host%d.com", (g+i)%len(hosts))
+				addrs, err := r.LookupHost(context.Background(), host)
+				if err == nil && len(addrs) == 1 {
+					// Results are copies the caller may modify.
+					addrs[0] = "0.0.0.0"
+				}
+			}
+		}(g)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if i%2 == 0 {
+				f.setErr(errors.New("server failure"))
+			} else {
+				f.setErr(nil)
+			}
+			r.Refresh()
+		}
+	}()
+	wg.Wait()
+
+	f.setErr(nil)
+	r.Refresh()
+	for host, want := range hosts {
+		if got, err := r.LookupHost(context.Background(), host); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("LookupHost(%q) = (%v, %v), want %v", host, got, err, want)
+		}
+	}
+}
+
+func TestResolver_RefreshCoalescesWithLookups(t *testing.T) {
+	const n = 4
+	s := &slowResolver{delay: 100 * time.Millisecond}
+	r := NewDNSResolver(128)
+	r.Resolver = s
+	r.RefreshConcurrency = n
+	for i := 0; i < n; i++ {
+		r.LookupHost(context.Background(), fmt.Sprintf("host%d.com", i))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.Refresh()
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		inFlight := s.inFlight
+		s.mu.Unlock()
+		if inFlight == n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refresh lookups did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Bypass the cache so that only lookup coalescing can prevent the
+	// upstream calls.
+	ctx := WithForceRefresh(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(host string) {
+				defer wg.Done()
+				if _, err := r.LookupHost(ctx, host); err != nil {
+					t.Error(err)
+				}
+			}(fmt.Sprintf("host%d.com", i))
+		}
+	}
+	wg.Wait()
+	<-done
+	if got := s.callCount(); got != 2*n {
+		t.Errorf("got %d upstream calls, want %d: one per key to populate and one to refresh", got, 2*n)
+	}
+}
+
+func TestResolver_Close(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"1.2.3.4"}}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.LookupHost(context.Background(), "example.com")
+	if err := r.StartAutoRefresh(time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	done := r.refreshDone
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("auto-refresh goroutine still running after Close")
+	}
+	calls := f.callCount()
+	if _, err := r.LookupHost(context.Background(), "example.com"); err != ErrClosed {
+		t.Errorf("LookupHost: got %v, want ErrClosed", err)
+	}
+	if _, err := r.LookupAddr(context.Background(), "1.2.3.4"); err != ErrClosed {
+		t.Errorf("LookupAddr: got %v, want ErrClosed", err)
+	}
+	if addrs, stale, err := r.LookupHostStale(context.Background(), "example.com"); err != ErrClosed {
+		t.Errorf("LookupHostStale: got (%v, %v, %v), want ErrClosed", addrs, stale, err)
+	}
+	if addrs, ok := r.TryLookupHost("example.com"); ok {
+		t.Errorf("TryLookupHost: got %v, want no cached addresses", addrs)
+	}
+	if err := r.HealthCheck(context.Background(), "example.com"); err != ErrClosed {
+		t.Errorf("HealthCheck: got %v, want ErrClosed", err)
+	}
+	if err := r.StartAutoRefresh(time.Millisecond); err != ErrClosed {
+		t.Errorf("StartAutoRefresh: got %v, want ErrClosed", err)
+	}
+	r.Refresh()
+	if got := f.callCount(); got != calls {
+		t.Errorf("got %d upstream calls after Close, want none", got-calls)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("second Close: got %v, want nil", err)
+	}
+}
+
+func TestResolver_CloseLetsInFlightFinish(t *testing.T) {
+	b := &blockingResolver{addrs: []string{"1.2.3.4"}, release: make(chan struct{}), started: make(chan struct{}, 1)}
+	r := NewDNSResolver(128)
+	r.Resolver = b
+	errs := make(chan error)
+	go func() {
+		_, err := r.LookupHost(context.Background(), "example.com")
+		errs <- err
+	}()
+	<-b.started
+	r.Close()
+	close(b.release)
+	if err := <-errs; err != nil {
+		t.Errorf("in-flight lookup got %v, want success", err)
+	}
+}
+
+func TestResolver_RefreshSkipErrors(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{"good.example.com": {"192.0.2.1"}}}
+	r := NewDNSResolver(10)
+	r.Resolver = f
+	r.RefreshSkipErrors = true
+
+	r.LookupHost(context.Background(), "good.example.com")
+	f.setErr(errLookup)
+	r.LookupHost(context.Background(), "bad.example.com")
+	f.setErr(nil)
+
+	var refreshed []string
+	r.Resolver = FuncResolver{HostFunc: func(ctx context.Context, host string) ([]string, error) {
+		refreshed = append(refreshed, host)
+		return f.LookupHost(ctx, host)
+	}}
+	r.Refresh()
+	if want := []string{"good.example.com"}; !reflect.DeepEqual(refreshed, want) {
+		t.Errorf("refreshed %v, want %v", refreshed, want)
+	}
+}
+
+func TestResolver_RefreshKey(t *testing.T) {
+	f := &fakeResolver{
+		hosts: map[string][]string{"a.com": {"192.0.2.1"}, "b.com": {"192.0.2.2"}},
+		addrs: map[string][]string{"192.0.2.1": {"a.com."}},
+	}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	ctx := context.Background()
+	r.LookupHost(ctx, "a.com")
+	r.LookupHost(ctx, "b.com")
+	r.LookupAddr(ctx, "192.0.2.1")
+
+	f.mu.Lock()
+	f.hosts = map[string][]string{"a.com": {"192.0.2.10"}, "b.com": {"192.0.2.20"}}
+	f.addrs = map[string][]string{"192.0.2.1": {"c.com."}}
+	f.mu.Unlock()
+	calls := f.callCount()
+	addrs, err := r.RefreshKey(ctx, "a.com")
+	if err != nil || !reflect.DeepEqual(addrs, []string{"192.0.2.10"}) {
+		t.Errorf("RefreshKey: got (%v, %v), want [192.0.2.10]", addrs, err)
+	}
+	names, err := r.RefreshAddrKey(ctx, "192.0.2.1")
+	if err != nil || !reflect.DeepEqual(names, []string{"c.com."}) {
+		t.Errorf("RefreshAddrKey: got (%v, %v), want [c.com.]", names, err)
+	}
+	if got := f.callCount() - calls; got != 2 {
+		t.Errorf("got %d upstream lookups, want 2", got)
+	}
+
+	calls = f.callCount()
+	if addrs, _ := r.LookupHost(ctx, "a.com"); !reflect.DeepEqual(addrs, []string{"192.0.2.10"}) {
+		t.Errorf("got cached %v for a.com, want [192.0.2.10]", addrs)
+	}
+	if names, _ := r.LookupAddr(ctx, "192.0.2.1"); !reflect.DeepEqual(names, []string{"c.com."}) {
+		t.Errorf("got cached %v for 192.0.2.1, want [c.com.]", names)
+	}
+	if addrs, _ := r.LookupHost(ctx, "b.com"); !reflect.DeepEqual(addrs, []string{"192.0.2.2"}) {
+		t.Errorf("got cached %v for b.com, want it untouched", addrs)
+	}
+	if got := f.callCount() - calls; got != 0 {
+		t.Errorf("got %d upstream lookups after refreshing, want 0", got)
+	}
+
+	if _, err := r.RefreshAddrKey(ctx, "a.com"); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("got %v for a host name, want ErrInvalidName", err)
+	}
+	r.Close()
+	if _, err := r.RefreshKey(ctx, "a.com"); err != ErrClosed {
+		t.Errorf("got %v after Close, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,54 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// retry returns the lookup function for key, retrying up to Retries times on
+// transient errors. All attempts are bound to ctx and Timeout.
+func (r *Resolver) retry(ctx context.Context, key cacheKey) func() (interface{}, error) {
+	if r.Retries <= 0 {
+		return r.lookupFunc(ctx, key)
+	}
+	return func() (interface{}, error) {
+		ctx, cancel := r.getCtx(ctx)
+		defer cancel()
+		fn := r.lookupFunc(ctx, key)
+		for attempt := 0; ; attempt++ {
+			val, err := fn()
+			if err == nil || attempt >= r.Retries || !IsRetryable(err) {
+				return val, err
+			}
+			if r.RetryBackoff > 0 {
+				t := time.NewTimer(r.RetryBackoff)
+				select {
+				case <-t.C:
+				case <-ctx.Done():
+					t.Stop()
+					return val, err
+				}
+			} else if ctx.Err() != nil {
+				return val, err
+			}
+		}
+	}
+}
+
+// IsRetryable reports whether err is a timeout or temporary failure, such as
+// a server failure, worth retrying, unlike a not found error or a
+// cancellation by the caller. It works on errors served from the cache as
+// well as on the original upstream errors.
+func IsRetryable(err error) bool {
+	if isContextErr(err) || isNotFound(err) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
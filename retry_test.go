@@ -0,0 +1,173 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyResolver is a DNSResolver failing with err for the first failures
+// lookups, then answering addrs.
+type flakyResolver struct {
+	mu       sync.Mutex
+	err      error
+	failures int
+	addrs    []string
+	calls    int
+}
+
+func (f *flakyResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, f.err
+	}
+	return f.addrs, nil
+}
+
+func (f *flakyResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return f.LookupHost(ctx, addr)
+}
+
+func (f *flakyResolver) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func TestResolver_Retries(t *testing.T) {
+	errTimeout := &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}
+	errServFail := &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}
+	errRefused := errors.New("connection refused")
+	for _, tt := range []struct {
+		name      string
+		err       error
+		retries   int
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "timeout", err: errTimeout, retries: 2, wantCalls: 3},
+		{name: "servfail", err: errServFail, retries: 2, wantCalls: 3},
+		{name: "too few retries", err: errTimeout, retries: 1, wantErr: errTimeout, wantCalls: 2},
+		{name: "no retries", err: errTimeout, wantErr: errTimeout, wantCalls: 1},
+		{name: "not found", err: errLookup, retries: 2, wantErr: errLookup, wantCalls: 1},
+		{name: "other error", err: errRefused, retries: 2, wantErr: errRefused, wantCalls: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &flakyResolver{err: tt.err, failures: 2, addrs: []string{"10.0.0.1"}}
+			r := NewDNSResolver(128)
+			r.Resolver = f
+			r.Retries = tt.retries
+			r.RetryBackoff = time.Millisecond
+
+			addrs, err := r.LookupHost(context.Background(), "example.com")
+			if tt.wantErr != nil {
+				if err != tt.wantErr {
+					t.Errorf("got error %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil || !reflect.DeepEqual(addrs, f.addrs) {
+				t.Errorf("got (%v, %v), want %v", addrs, err, f.addrs)
+			}
+			if got := f.callCount(); got != tt.wantCalls {
+				t.Errorf("got %d upstream calls, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestResolver_RetriedSuccessCached(t *testing.T) {
+	f := &flakyResolver{
+		err:      &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true},
+		failures: 2,
+		addrs:    []string{"10.0.0.1"},
+	}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.Retries = 2
+
+	for i := 0; i < 3; i++ {
+		if addrs, err := r.LookupHost(context.Background(), "example.com"); err != nil || !reflect.DeepEqual(addrs, f.addrs) {
+			t.Errorf("got (%v, %v), want %v", addrs, err, f.addrs)
+		}
+	}
+	if got := f.callCount(); got != 3 {
+		t.Errorf("got %d upstream calls, want 3", got)
+	}
+}
+
+func TestResolver_RetriesBoundByTimeout(t *testing.T) {
+	f := &flakyResolver{
+		err:      &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true},
+		failures: 100,
+	}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.Timeout = 50 * time.Millisecond
+	r.Retries = 100
+	r.RetryBackoff = 20 * time.Millisecond
+
+	start := time.Now()
+	if _, err := r.LookupHost(context.Background(), "example.com"); err == nil {
+		t.Fatal("got no error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retries took %v, want them bound by Timeout", elapsed)
+	}
+	if got := f.callCount(); got > 4 {
+		t.Errorf("got %d upstream calls within Timeout, want at most 4", got)
+	}
+}
+
+// timeoutError is a net.Error reporting a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "dial timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		want    bool
+		timeout bool
+	}{
+		{"timeout", &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, true, true},
+		{"not found", errLookup, false, false},
+		{"server failure", &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}, true, false},
+		{"net timeout", timeoutError{}, true, true},
+		{"other", errors.New("upstream unreachable"), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewDNSResolver(128)
+			r.Resolver = &fakeResolver{err: tt.err}
+			r.NegativeTTL = time.Minute
+			r.TransientErrorTTL = time.Minute
+
+			_, err := r.LookupHost(context.Background(), "example.com")
+			if got := IsRetryable(err); got != tt.want {
+				t.Errorf("IsRetryable(upstream %v) = %v, want %v", err, got, tt.want)
+			}
+			_, err = r.LookupHost(context.Background(), "example.com")
+			if _, ok := err.(*cachedError); !ok {
+				t.Fatalf("got %T, want a cached error", err)
+			}
+			if got := IsRetryable(err); got != tt.want {
+				t.Errorf("IsRetryable(cached %v) = %v, want %v", err, got, tt.want)
+			}
+			var netErr net.Error
+			if !errors.As(err, &netErr) {
+				t.Fatal("cached error is not a net.Error")
+			}
+			if got := netErr.Timeout(); got != tt.timeout {
+				t.Errorf("cached error Timeout() = %v, want %v", got, tt.timeout)
+			}
+		})
+	}
+}
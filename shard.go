@@ -0,0 +1,257 @@
+package dnscache
+
+import (
+	"net"
+	"runtime"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// minShardSize is the minimum number of entries per shard when the number of
+// shards is derived from GOMAXPROCS, so small caches keep exact LRU eviction.
+const minShardSize = 128
+
+// shard is an independently locked part of the cache. Keys are spread across
+// shards by hash so concurrent lookups of different keys rarely contend on
+// the same lock.
+type shard struct {
+	// mu guards the entries stored in cache, and collect and evicted.
+	mu    sync.RWMutex
+	cache Cache
+
+	// evicted holds the keys evicted by cache while collect is set, to be
+	// passed to OnEvict once mu is released.
+	collect bool
+	evicted []cacheKey
+
+	// maxBytes, if > 0, bounds bytes, the estimated size of the entries.
+	maxBytes int
+	bytes    int
+}
+
+// newShards creates n shards sharing size entries, evicting entries
+// according to policy. If n <= 0, the number of shards is derived from
+// GOMAXPROCS.
+func newShards(n, size int, policy EvictionPolicy) ([]*shard, error) {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+		if max := size / minShardSize; n > max {
+			n = max
+		}
+	}
+	if n > size {
+		n = size
+	}
+	if n < 1 {
+		n = 1
+	}
+	shards := make([]*shard, n)
+	for i, shardSize := range splitSize(size, n) {
+		s := &shard{}
+		var err error
+		if policy == LFU {
+			s.cache, err = newLFU(shardSize, s.onEvict)
+		} else {
+			s.cache, err = lru.NewWithEvict(shardSize, s.onEvict)
+		}
+		if err != nil {
+			return nil, err
+		}
+		shards[i] = s
+	}
+	return shards, nil
+}
+
+// add adds an entry to the shard, returning the number of entries evicted to
+// make room for it. The shard lock must be held.
+func (s *shard) add(key cacheKey, e *cacheEntry) int {
+	if s.maxBytes > 0 {
+		if old, found := s.peek(key); found {
+			s.bytes -= entrySize(key, old.(*cacheEntry))
+		}
+		s.bytes += entrySize(key, e)
+	}
+	n := len(s.evicted)
+	s.collect = true
+	evicted := s.cache.Add(key, e)
+	if ro, ok := s.cache.(oldestRemover); ok {
+		for s.bytes > s.maxBytes && s.maxBytes > 0 && s.cache.Len() > 1 {
+			ro.RemoveOldest()
+		}
+	}
+	s.collect = false
+	if n = len(s.evicted) - n; n == 0 && evicted {
+		// The Cache does not report evicted keys.
+		n = 1
+	}
+	return n
+}
+
+// resize resizes the cache of the shard, returning the number of entries
+// evicted. The cache must implement resizer and the shard lock must be held.
+func (s *shard) resize(size int) int {
+	s.collect = true
+	evicted := s.cache.(resizer).Resize(size)
+	s.collect = false
+	return evicted
+}
+
+// onEvict is the eviction callback of the LRU cache of the shard. As the
+// LRU cache also calls it on removals, only the evictions made by add and
+// resize are collected.
+func (s *shard) onEvict(key, value interface{}) {
+	if s.maxBytes > 0 {
+		s.bytes -= entrySize(key.(cacheKey), value.(*cacheEntry))
+	}
+	if s.collect {
+		s.evicted = append(s.evicted, key.(cacheKey))
+	}
+}
+
+// takeEvicted returns and forgets the keys evicted since the last call. The
+// shard lock must be held.
+func (s *shard) takeEvicted() []cacheKey {
+	keys := s.evicted
+	s.evicted = nil
+	return keys
+}
+
+// notifyEvicted calls OnEvict for each evicted key. No shard lock may be
+// held.
+func (r *Resolver) notifyEvicted(keys []cacheKey) {
+	if r.OnEvict == nil {
+		return
+	}
+	for _, key := range keys {
+		r.OnEvict(key.subject)
+	}
+}
+
+// peeker is implemented by Cache backends able to return an entry without
+// updating its recency or frequency of use, such as the default LRU cache.
+type peeker interface {
+	Peek(key interface{}) (value interface{}, ok bool)
+}
+
+// peek returns the entry stored for key, without counting a use of it if the
+// Cache supports it. The shard lock must be held.
+func (s *shard) peek(key cacheKey) (interface{}, bool) {
+	if p, ok := s.cache.(peeker); ok {
+		return p.Peek(key)
+	}
+	return s.cache.Get(key)
+}
+
+// oldestRemover is implemented by Cache backends able to evict their least
+// recently used entry, such as the default LRU cache.
+type oldestRemover interface {
+	RemoveOldest() (key, value interface{}, ok bool)
+}
+
+// entryOverhead is the estimated size of a cache entry besides its strings.
+const entryOverhead = 128
+
+// entrySize returns the estimated size in bytes of the entry e stored for
+// key, from the lengths of its strings plus fixed overheads.
+func entrySize(key cacheKey, e *cacheEntry) int {
+	n := entryOverhead + len(key.subject)
+	if e.err != nil {
+		n += len(e.err.Error())
+	}
+	switch v := e.val.(type) {
+	case []string:
+		for _, s := range v {
+			n += 16 + len(s)
+		}
+	case string:
+		n += len(v)
+	case []*net.MX:
+		for _, mx := range v {
+			n += 32 + len(mx.Host)
+		}
+	case []*net.NS:
+		for _, ns := range v {
+			n += 24 + len(ns.Host)
+		}
+	case srvResult:
+		n += len(v.cname)
+		for _, srv := range v.addrs {
+			n += 32 + len(srv.Target)
+		}
+	}
+	return n
+}
+
+// splitSize splits size in n parts differing by at most one.
+func splitSize(size, n int) []int {
+	sizes := make([]int, n)
+	for i := range sizes {
+		sizes[i] = size / n
+		if i < size%n {
+			sizes[i]++
+		}
+	}
+	return sizes
+}
+
+// getShards returns the cache shards. If the Resolver was not created by
+// New, a cache of defaultCacheSize entries is created on first use. Shards
+// missing their cache are treated as empty and never store entries.
+func (r *Resolver) getShards() []*shard {
+	r.once.Do(func() {
+		if r.shards == nil {
+			r.shards, _ = newShards(0, defaultCacheSize, LRU)
+		}
+		for _, s := range r.shards {
+			if s.cache == nil {
+				s.cache = nopCache{}
+			}
+		}
+	})
+	return r.shards
+}
+
+// forwardShards returns the shards holding all lookups but the reverse ones
+// kept apart with WithAddrCacheSize.
+func (r *Resolver) forwardShards() []*shard {
+	shards := r.getShards()
+	return shards[:len(shards)-len(r.addrShards)]
+}
+
+// shard returns the shard holding key.
+func (r *Resolver) shard(key cacheKey) *shard {
+	shards := r.forwardShards()
+	if key.kind == KindAddr && r.addrShards != nil {
+		shards = r.addrShards
+	}
+	if len(shards) == 1 {
+		return shards[0]
+	}
+	return shards[key.hash()%uint32(len(shards))]
+}
+
+// keys returns the keys of all shards, from oldest to newest within each
+// shard.
+func (r *Resolver) keys() []cacheKey {
+	var keys []cacheKey
+	for _, s := range r.getShards() {
+		s.mu.RLock()
+		for _, key := range s.cache.Keys() {
+			keys = append(keys, key.(cacheKey))
+		}
+		s.mu.RUnlock()
+	}
+	return keys
+}
+
+// hash returns the 32-bit FNV-1a hash of the key.
+func (k cacheKey) hash() uint32 {
+	const prime = 16777619
+	h := uint32(2166136261)
+	h = (h ^ uint32(k.kind)) * prime
+	for i := 0; i < len(k.subject); i++ {
+		h = (h ^ uint32(k.subject[i])) * prime
+	}
+	return h
+}
@@ -0,0 +1,138 @@
+package dnscache
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestNewShards(t *testing.T) {
+	for _, tt := range []struct {
+		n, size int
+		want    []int
+	}{
+		{n: 4, size: 10, want: []int{3, 3, 2, 2}},
+		{n: 4, size: 2, want: []int{1, 1}},
+		{n: 1, size: 5, want: []int{5}},
+	} {
+		shards, err := newShards(tt.n, tt.size, LRU)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for _, s := range shards {
+			s.cache.Add("a", 1)
+			s.cache.Add("b", 2)
+			s.cache.Add("c", 3)
+			got = append(got, s.cache.Len())
+		}
+		want := make([]int, len(tt.want))
+		for i, size := range tt.want {
+			want[i] = size
+			if size > 3 {
+				want[i] = 3
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("newShards(%d, %d): got shard lengths %v, want %v", tt.n, tt.size, got, want)
+		}
+	}
+	if shards, _ := newShards(0, minShardSize-1, LRU); len(shards) != 1 {
+		t.Errorf("got %d default shards for a small cache, want 1", len(shards))
+	}
+}
+
+func TestResolver_Shards(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{}}
+	for i := 0; i < 100; i++ {
+		f.hosts[fmt.Sprintf("host%d.com", i)] = []string{fmt.Sprintf("10.0.0.%d", i)}
+	}
+	r, err := New(WithCacheSize(1000), WithShards(8), WithResolver(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.shards) != 8 {
+		t.Fatalf("got %d shards, want 8", len(r.shards))
+	}
+	var want []Key
+	for i := 0; i < 100; i++ {
+		host := fmt.Sprintf("host%d.com", i)
+		r.LookupHost(context.Background(), host)
+		want = append(want, Key{KindHost, host})
+	}
+	used := 0
+	for _, s := range r.shards {
+		if s.cache.Len() > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("got entries in %d shards, want them spread", used)
+	}
+	if got := r.Len(); got != 100 {
+		t.Errorf("got %d entries, want 100", got)
+	}
+	got := r.Keys()
+	sort.Slice(got, func(i, j int) bool { return got[i].Subject < got[j].Subject })
+	sort.Slice(want, func(i, j int) bool { return want[i].Subject < want[j].Subject })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got keys %v, want %v", got, want)
+	}
+	for i := 0; i < 100; i++ {
+		host := fmt.Sprintf("host%d.com", i)
+		addrs, err := r.LookupHost(context.Background(), host)
+		if err != nil || !reflect.DeepEqual(addrs, f.hosts[host]) {
+			t.Errorf("LookupHost(%q) = %v, %v, want %v", host, addrs, err, f.hosts[host])
+		}
+	}
+	if got := f.callCount(); got != 100 {
+		t.Errorf("got %d upstream calls, want 100", got)
+	}
+	f.setHosts(map[string][]string{"host1.com": {"10.0.1.1"}})
+	r.Refresh()
+	if addrs, _ := r.LookupHost(context.Background(), "host1.com"); !reflect.DeepEqual(addrs, []string{"10.0.1.1"}) {
+		t.Errorf("got %v after refresh, want [10.0.1.1]", addrs)
+	}
+	r.Clear()
+	if got := r.Len(); got != 0 {
+		t.Errorf("got %d entries after Clear, want 0", got)
+	}
+}
+
+func TestWithShards_Invalid(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		if _, err := New(WithShards(n)); err == nil {
+			t.Errorf("New(WithShards(%d)) succeeded, want an error", n)
+		}
+	}
+}
+
+func BenchmarkLookupHostParallel(b *testing.B) {
+	f := &fakeResolver{hosts: map[string][]string{}}
+	hosts := make([]string, 1000)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("host%d.com", i)
+		f.hosts[hosts[i]] = []string{"10.0.0.1"}
+	}
+	for _, n := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", n), func(b *testing.B) {
+			r, err := New(WithCacheSize(len(hosts)*2), WithShards(n), WithResolver(f))
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, host := range hosts {
+				r.LookupHost(context.Background(), host)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					r.LookupHost(context.Background(), hosts[i%len(hosts)])
+					i++
+				}
+			})
+		})
+	}
+}
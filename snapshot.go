@@ -0,0 +1,101 @@
+package dnscache
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// EntrySnapshot is a copy of a cache entry returned by Snapshot, e.g. to dump
+// the cache as JSON on an admin endpoint.
+type EntrySnapshot struct {
+	// Kind is the type of lookup, one of the Kind constants as a string.
+	Kind string `json:"kind"`
+	// Subject is the looked up host, address or domain name.
+	Subject string `json:"subject"`
+	// Records holds the cached records of a successful lookup: addresses,
+	// names or TXT records as is, and MX, NS and SRV records formatted like
+	// in a zone file, without their owner name.
+	Records []string `json:"records,omitempty"`
+	// Negative marks a failed lookup, whose error is Error. NotFound tells
+	// whether it is a not found error.
+	Negative bool   `json:"negative,omitempty"`
+	NotFound bool   `json:"not_found,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// StoredAt is the time the entry was last looked up upstream.
+	StoredAt time.Time `json:"stored_at"`
+	// Expire is the expiry time of the entry, zero if it never expires.
+	Expire time.Time `json:"expire"`
+}
+
+// Snapshot returns a copy of all cache entries, expired or not. All shards
+// are locked while entries are copied, so the snapshot reflects the cache at
+// a single point in time. With a single shard, entries are ordered from
+// oldest to newest.
+func (r *Resolver) Snapshot() []EntrySnapshot {
+	shards := r.getShards()
+	for _, s := range shards {
+		s.mu.RLock()
+	}
+	var entries []EntrySnapshot
+	for _, s := range shards {
+		for _, key := range s.cache.Keys() {
+			v, found := s.peek(key.(cacheKey))
+			if !found {
+				continue
+			}
+			k := key.(cacheKey)
+			e := v.(*cacheEntry)
+			es := EntrySnapshot{
+				Kind:     string(k.kind),
+				Subject:  k.subject,
+				Negative: e.err != nil,
+				NotFound: isNotFound(e.err),
+				StoredAt: e.storedAt,
+				Expire:   e.expire,
+			}
+			if e.err != nil {
+				es.Error = e.err.Error()
+			} else {
+				es.Records = formatRecords(e.val)
+			}
+			entries = append(entries, es)
+		}
+	}
+	for _, s := range shards {
+		s.mu.RUnlock()
+	}
+	return entries
+}
+
+// formatRecords returns the records of a cached value as strings.
+func formatRecords(val interface{}) []string {
+	switch v := val.(type) {
+	case []string:
+		return append([]string(nil), v...)
+	case string:
+		return []string{v}
+	case int:
+		return []string{strconv.Itoa(v)}
+	case []*net.MX:
+		out := make([]string, len(v))
+		for i, mx := range v {
+			out[i] = fmt.Sprintf("%d %s", mx.Pref, mx.Host)
+		}
+		return out
+	case []*net.NS:
+		out := make([]string, len(v))
+		for i, ns := range v {
+			out[i] = ns.Host
+		}
+		return out
+	case srvResult:
+		out := make([]string, len(v.addrs))
+		for i, srv := range v.addrs {
+			out[i] = fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, srv.Target)
+		}
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResolver_Snapshot(t *testing.T) {
+	clock := newFakeClock()
+	f := &fakeResolver{
+		hosts: map[string][]string{"example.com": {"192.0.2.1", "2001:db8::1"}},
+		addrs: map[string][]string{"192.0.2.1": {"example.com."}},
+		mxs:   map[string][]*net.MX{"example.com": {{Host: "mx.example.com.", Pref: 10}}},
+	}
+	r, err := New(WithCacheSize(10), WithShards(1), WithResolver(f), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.TTL = time.Minute
+	r.NegativeTTL = time.Second
+
+	ctx := context.Background()
+	r.LookupHost(ctx, "example.com")
+	r.LookupAddr(ctx, "192.0.2.1")
+	r.LookupMX(ctx, "example.com")
+	f.setErr(errLookup)
+	r.LookupHost(ctx, "missing.example.com")
+
+	now := clock.Now()
+	want := []EntrySnapshot{
+		{Kind: "h", Subject: "example.com", Records: []string{"192.0.2.1", "2001:db8::1"}, StoredAt: now, Expire: now.Add(time.Minute)},
+		{Kind: "r", Subject: "192.0.2.1", Records: []string{"example.com."}, StoredAt: now, Expire: now.Add(time.Minute)},
+		{Kind: "m", Subject: "example.com", Records: []string{"10 mx.example.com."}, StoredAt: now, Expire: now.Add(time.Minute)},
+		{Kind: "h", Subject: "missing.example.com", Negative: true, NotFound: true, Error: errLookup.Error(), StoredAt: now, Expire: now.Add(time.Second)},
+	}
+	if got := r.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got snapshot\n%+v\nwant\n%+v", got, want)
+	}
+}
@@ -0,0 +1,79 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+)
+
+// Tracer starts spans for lookups. It is a minimal interface so this package
+// does not depend on a tracing library; adapting an OpenTelemetry tracer only
+// takes a few lines.
+type Tracer interface {
+	// Start starts a span named name, returning a context carrying it.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute sets an attribute on the span.
+	SetAttribute(key string, value interface{})
+	// RecordError records err as the outcome of the span.
+	RecordError(err error)
+	// End completes the span.
+	End()
+}
+
+// Attributes set on lookup spans.
+const (
+	AttrKind        = "dns.kind"
+	AttrSubject     = "dns.subject"
+	AttrCacheHit    = "dns.cache_hit"
+	AttrResultCount = "dns.result_count"
+)
+
+// startSpan starts a lookup span for key, or returns a nil span if no Tracer
+// is configured.
+func (r *Resolver) startSpan(ctx context.Context, key cacheKey) (context.Context, Span) {
+	if r.Tracer == nil {
+		return ctx, nil
+	}
+	ctx, span := r.Tracer.Start(ctx, "dnscache.lookup")
+	span.SetAttribute(AttrKind, string(key.kind))
+	span.SetAttribute(AttrSubject, key.subject)
+	return ctx, span
+}
+
+// endSpan records the outcome of a lookup on span and ends it.
+func endSpan(span Span, hit bool, val interface{}, err error) {
+	if span == nil {
+		return
+	}
+	span.SetAttribute(AttrCacheHit, hit)
+	span.SetAttribute(AttrResultCount, resultCount(val))
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// resultCount returns the number of records held by a lookup result.
+func resultCount(val interface{}) int {
+	switch v := val.(type) {
+	case []string:
+		return len(v)
+	case string:
+		if v == "" {
+			return 0
+		}
+		return 1
+	case []*net.MX:
+		return len(v)
+	case []*net.NS:
+		return len(v)
+	case srvResult:
+		return len(v.addrs)
+	case int:
+		return 1
+	}
+	return 0
+}
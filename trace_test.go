@@ -0,0 +1,79 @@
+package dnscache
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+type fakeTracer struct {
+	mu    sync.Mutex
+	spans []*fakeSpan
+}
+
+func (t *fakeTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &fakeSpan{name: name, attrs: map[string]interface{}{}}
+	t.spans = append(t.spans, s)
+	return ctx, s
+}
+
+type fakeSpan struct {
+	name  string
+	attrs map[string]interface{}
+	err   error
+	ended bool
+}
+
+func (s *fakeSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *fakeSpan) RecordError(err error)                      { s.err = err }
+func (s *fakeSpan) End()                                       { s.ended = true }
+
+func TestResolver_Tracer(t *testing.T) {
+	tracer := &fakeTracer{}
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"1.1.1.1", "2.2.2.2"}}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.Tracer = tracer
+
+	r.LookupHost(context.Background(), "example.com")
+	r.LookupHost(context.Background(), "example.com")
+	f.setErr(errLookup)
+	r.LookupHost(context.Background(), "fail.com")
+
+	if len(tracer.spans) != 3 {
+		t.Fatalf("got %d spans, want 3", len(tracer.spans))
+	}
+	tests := []struct {
+		hit     bool
+		subject string
+		count   int
+		err     error
+	}{
+		{false, "example.com", 2, nil},
+		{true, "example.com", 2, nil},
+		{false, "fail.com", 0, errLookup},
+	}
+	for i, tt := range tests {
+		s := tracer.spans[i]
+		if !s.ended {
+			t.Errorf("span %d not ended", i)
+		}
+		if s.name != "dnscache.lookup" {
+			t.Errorf("span %d: got name %q", i, s.name)
+		}
+		if s.attrs[AttrKind] != "h" || s.attrs[AttrSubject] != tt.subject {
+			t.Errorf("span %d: got kind %v and subject %v", i, s.attrs[AttrKind], s.attrs[AttrSubject])
+		}
+		if s.attrs[AttrCacheHit] != tt.hit {
+			t.Errorf("span %d: got cache hit %v, want %v", i, s.attrs[AttrCacheHit], tt.hit)
+		}
+		if s.attrs[AttrResultCount] != tt.count {
+			t.Errorf("span %d: got result count %v, want %d", i, s.attrs[AttrResultCount], tt.count)
+		}
+		if s.err != tt.err {
+			t.Errorf("span %d: got error %v, want %v", i, s.err, tt.err)
+		}
+	}
+}
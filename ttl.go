@@ -0,0 +1,107 @@
+package dnscache
+
+import (
+	"context"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// TTLResolver is implemented by DNSResolvers able to report the TTL of the
+// records they return. When the configured Resolver implements it, entries
+// expire after the TTL returned by the DNS server instead of the static TTL,
+// still bounded by MinTTL and MaxTTL. The static TTL need not be set: it only
+// applies to lookups whose TTL is unknown, reported as a negative TTL, and to
+// the kinds of lookups not covered by the interface. Without it, such entries
+// never expire.
+//
+// net.Resolver does not expose record TTLs; a resolver built on a DNS library
+// such as github.com/miekg/dns can be adapted to implement this interface.
+type TTLResolver interface {
+	// LookupHostTTL is like LookupHost, also returning the smallest TTL of
+	// the returned records.
+	LookupHostTTL(ctx context.Context, host string) (addrs []string, ttl time.Duration, err error)
+	// LookupAddrTTL is like LookupAddr, also returning the smallest TTL of
+	// the returned records.
+	LookupAddrTTL(ctx context.Context, addr string) (names []string, ttl time.Duration, err error)
+}
+
+// noTTL is the record TTL of lookups made through resolvers not reporting
+// TTLs.
+const noTTL time.Duration = -1
+
+// ttlResult is the result of a lookup made through a TTLResolver.
+type ttlResult struct {
+	val interface{}
+	ttl time.Duration
+}
+
+// ttlLookupFunc returns the lookup function for key using resolver, or nil if
+// resolver does not report TTLs for the kind of key.
+func (r *Resolver) ttlLookupFunc(ctx context.Context, resolver DNSResolver, key cacheKey) func() (interface{}, error) {
+	tr, ok := resolver.(TTLResolver)
+	if !ok {
+		return nil
+	}
+	var lookup func(ctx context.Context, subject string) ([]string, time.Duration, error)
+	switch key.kind {
+	case KindHost:
+		lookup = tr.LookupHostTTL
+	case KindAddr:
+		lookup = tr.LookupAddrTTL
+	default:
+		return nil
+	}
+	return func() (interface{}, error) {
+		ctx, cancel := r.getCtx(ctx)
+		defer cancel()
+		rrs, ttl, err := lookup(ctx, key.subject)
+		if err != nil {
+			return nil, err
+		}
+		if ttl < 0 {
+			ttl = noTTL
+		}
+		return ttlResult{val: rrs, ttl: ttl}, nil
+	}
+}
+
+// SetTTL overrides the TTL of the entry for host, taking precedence over TTL
+// and the TTL of the records for successful lookups stored from now on. A
+// ttl <= 0 removes the override. Overrides are kept for at most as many hosts
+// as the cache holds entries, the least recently set being dropped first.
+func (r *Resolver) SetTTL(host string, ttl time.Duration) {
+	key := r.key(KindHost, host)
+	// The size is read before locking overrideMu, which is taken by stores
+	// holding a shard lock, itself taken by Resize holding sizeMu.
+	size := r.size()
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+	r.overrideMu.Lock()
+	defer r.overrideMu.Unlock()
+	if ttl <= 0 {
+		if r.overrides != nil {
+			r.overrides.Remove(key)
+		}
+		return
+	}
+	if r.overrides == nil {
+		r.overrides, _ = lru.New(size)
+	}
+	r.overrides.Add(key, ttl)
+}
+
+// ttlOverride returns the TTL set with SetTTL for key, if any.
+func (r *Resolver) ttlOverride(key cacheKey) (time.Duration, bool) {
+	r.overrideMu.Lock()
+	defer r.overrideMu.Unlock()
+	if r.overrides == nil {
+		return 0, false
+	}
+	ttl, ok := r.overrides.Peek(key)
+	if !ok {
+		return 0, false
+	}
+	return ttl.(time.Duration), true
+}
@@ -0,0 +1,195 @@
+package dnscache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// ttlResolver is a fakeResolver reporting the same TTL for all records.
+type ttlResolver struct {
+	*fakeResolver
+	ttl time.Duration
+}
+
+func (t *ttlResolver) LookupHostTTL(ctx context.Context, host string) ([]string, time.Duration, error) {
+	addrs, err := t.LookupHost(ctx, host)
+	return addrs, t.ttl, err
+}
+
+func (t *ttlResolver) LookupAddrTTL(ctx context.Context, addr string) ([]string, time.Duration, error) {
+	names, err := t.LookupAddr(ctx, addr)
+	return names, t.ttl, err
+}
+
+func TestResolver_DNSTTL(t *testing.T) {
+	clock := newFakeClock()
+	f := &fakeResolver{
+		hosts: map[string][]string{"example.com": {"1.2.3.4"}},
+		addrs: map[string][]string{"1.2.3.4": {"example.com."}},
+	}
+	r := NewDNSResolver(128)
+	r.Resolver = &ttlResolver{fakeResolver: f, ttl: 30 * time.Second}
+	r.TTL = time.Hour
+	r.clock = clock
+
+	lookup := func() {
+		if _, err := r.LookupHost(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.LookupAddr(context.Background(), "1.2.3.4"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lookup()
+	clock.Advance(29 * time.Second)
+	lookup()
+	if f.callCount() != 2 {
+		t.Errorf("got %d upstream calls before the DNS TTL, want 2", f.callCount())
+	}
+	clock.Advance(time.Second)
+	lookup()
+	if f.callCount() != 4 {
+		t.Errorf("got %d upstream calls after the DNS TTL, want 4", f.callCount())
+	}
+}
+
+func TestResolver_DNSTTLZero(t *testing.T) {
+	clock := newFakeClock()
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"1.2.3.4"}}}
+	r := NewDNSResolver(128)
+	r.Resolver = &ttlResolver{fakeResolver: f}
+	r.TTL = time.Hour
+	r.clock = clock
+
+	r.LookupHost(context.Background(), "example.com")
+	r.LookupHost(context.Background(), "example.com")
+	if f.callCount() != 2 {
+		t.Errorf("got %d upstream calls, want zero TTL records not to be reused", f.callCount())
+	}
+
+	r.MinTTL = time.Second
+	r.LookupHost(context.Background(), "example.com")
+	r.LookupHost(context.Background(), "example.com")
+	if f.callCount() != 3 {
+		t.Errorf("got %d upstream calls, want zero TTL records held for MinTTL", f.callCount())
+	}
+}
+
+func TestResolver_SetTTL(t *testing.T) {
+	clock := newFakeClock()
+	f := &fakeResolver{hosts: map[string][]string{
+		"cdn.example.com":    {"1.2.3.4"},
+		"stable.example.com": {"5.6.7.8"},
+	}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.TTL = time.Hour
+	r.clock = clock
+	r.SetTTL("cdn.example.com", time.Second)
+
+	lookup := func() {
+		for host := range f.hosts {
+			if _, err := r.LookupHost(context.Background(), host); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	lookup()
+	clock.Advance(time.Second)
+	lookup()
+	if got := f.callCount(); got != 3 {
+		t.Errorf("got %d upstream calls after the override TTL, want 3", got)
+	}
+
+	r.SetTTL("cdn.example.com", 0)
+	r.Refresh()
+	clock.Advance(time.Second)
+	lookup()
+	if got := f.callCount(); got != 5 {
+		t.Errorf("got %d upstream calls after removing the override, want 5", got)
+	}
+}
+
+func TestResolver_SetTTLBounded(t *testing.T) {
+	r := NewDNSResolver(2)
+	for _, host := range []string{"a.com", "b.com", "c.com"} {
+		r.SetTTL(host, time.Second)
+	}
+	if _, ok := r.ttlOverride(cacheKey{kind: KindHost, subject: "a.com"}); ok {
+		t.Error("got override for the oldest host beyond the cache size")
+	}
+	if got := r.overrides.Len(); got != 2 {
+		t.Errorf("got %d overrides, want 2", got)
+	}
+}
+
+func TestResolver_DNSTTLWithoutStaticTTL(t *testing.T) {
+	clock := newFakeClock()
+	f := &fakeResolver{hosts: map[string][]string{"example.com": {"1.2.3.4"}}}
+	tr := &ttlResolver{fakeResolver: f, ttl: 30 * time.Second}
+	r := NewDNSResolver(128)
+	r.Resolver = tr
+	r.clock = clock
+
+	r.LookupHost(context.Background(), "example.com")
+	clock.Advance(29 * time.Second)
+	r.LookupHost(context.Background(), "example.com")
+	if f.callCount() != 1 {
+		t.Errorf("got %d upstream calls before the DNS TTL, want 1", f.callCount())
+	}
+	clock.Advance(time.Second)
+	r.LookupHost(context.Background(), "example.com")
+	if f.callCount() != 2 {
+		t.Errorf("got %d upstream calls after the DNS TTL, want 2", f.callCount())
+	}
+
+	// Records of unknown TTL fall back to the static TTL, here none.
+	tr.ttl = -time.Second
+	clock.Advance(30 * time.Second)
+	r.LookupHost(context.Background(), "example.com")
+	clock.Advance(24 * time.Hour)
+	r.LookupHost(context.Background(), "example.com")
+	if f.callCount() != 3 {
+		t.Errorf("got %d upstream calls, want records of unknown TTL never to expire", f.callCount())
+	}
+}
+
+func TestResolver_HostAndAddrTTL(t *testing.T) {
+	clock := newFakeClock()
+	f := &fakeResolver{
+		hosts: map[string][]string{"example.com": {"1.2.3.4"}},
+		addrs: map[string][]string{"1.2.3.4": {"example.com."}},
+	}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	r.TTL = time.Minute
+	r.HostTTL = time.Second
+	r.AddrTTL = time.Hour
+	r.clock = clock
+
+	lookup := func() {
+		if _, err := r.LookupHost(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.LookupAddr(context.Background(), "1.2.3.4"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lookup()
+	clock.Advance(time.Second)
+	lookup()
+	if f.callCount() != 3 {
+		t.Errorf("got %d upstream calls after HostTTL, want 3", f.callCount())
+	}
+	clock.Advance(time.Minute)
+	lookup()
+	if f.callCount() != 4 {
+		t.Errorf("got %d upstream calls after TTL, want only the host to be looked up again", f.callCount())
+	}
+	clock.Advance(time.Hour)
+	lookup()
+	if f.callCount() != 6 {
+		t.Errorf("got %d upstream calls after AddrTTL, want 6", f.callCount())
+	}
+}
@@ -0,0 +1,53 @@
+package dnscache
+
+// Auto-tuning thresholds. The cache grows when, since the previous tuning
+// step, at least autoTuneMinLookups lookups were made, less than
+// autoTuneMaxHitRatio of them were hits and at least one in
+// autoTuneEvictionRatio misses evicted an entry.
+const (
+	autoTuneMinLookups    = 100
+	autoTuneMaxHitRatio   = 0.8
+	autoTuneEvictionRatio = 10
+)
+
+// Tune performs one auto-tuning step: if the cache is evicting entries
+// frequently while the hit ratio is poor since the previous step, it doubles
+// the cache size, up to MaxCacheSize. The step following a resize only
+// records the counters, so that tuning decisions are based on the new size.
+// The cache never shrinks. Tune is called on each auto-refresh tick when
+// AutoTune is set; it does nothing if MaxCacheSize is not above the current
+// size.
+func (r *Resolver) Tune() {
+	r.tuneMu.Lock()
+	defer r.tuneMu.Unlock()
+	stats := r.Stats()
+	last := r.tuneStats
+	r.tuneStats = stats
+	if r.tuneSkip {
+		r.tuneSkip = false
+		return
+	}
+	size := r.size()
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+	if r.MaxCacheSize <= size {
+		return
+	}
+	hits := stats.Hits - last.Hits
+	misses := stats.Misses - last.Misses
+	evictions := stats.Evictions - last.Evictions
+	lookups := hits + misses
+	if lookups < autoTuneMinLookups || float64(hits) >= autoTuneMaxHitRatio*float64(lookups) {
+		return
+	}
+	if evictions == 0 || evictions*autoTuneEvictionRatio < misses {
+		return
+	}
+	size *= 2
+	if size > r.MaxCacheSize {
+		size = r.MaxCacheSize
+	}
+	r.Resize(size)
+	r.tuneSkip = true
+}
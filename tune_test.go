@@ -0,0 +1,101 @@
+package dnscache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResolver_Tune(t *testing.T) {
+	r, err := New(WithCacheSize(100), WithShards(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Resolver = &fakeResolver{}
+	r.MaxCacheSize = 800
+
+	// The workload cycles through more hosts than the cache holds, so LRU
+	// eviction makes every lookup a miss until the cache is large enough.
+	var sizes []int
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 500; i++ {
+			if _, err := r.LookupHost(context.Background(), fmt.Sprintf("host%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r.Tune()
+		sizes = append(sizes, r.size())
+	}
+	want := []int{200, 200, 400, 400, 800, 800, 800, 800, 800, 800}
+	if fmt.Sprint(sizes) != fmt.Sprint(want) {
+		t.Errorf("got sizes %v, want %v", sizes, want)
+	}
+	before := r.Stats()
+	for i := 0; i < 500; i++ {
+		r.LookupHost(context.Background(), fmt.Sprintf("host%d", i))
+	}
+	if got := r.Stats().Hits - before.Hits; got != 500 {
+		t.Errorf("got %d hits after tuning, want 500", got)
+	}
+}
+
+func TestResolver_TuneHighHitRatio(t *testing.T) {
+	r, err := New(WithCacheSize(100), WithShards(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Resolver = &fakeResolver{}
+	r.MaxCacheSize = 800
+
+	// A few hosts outside a hot set evict entries, but most lookups hit.
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 1000; i++ {
+			r.LookupHost(context.Background(), fmt.Sprintf("host%d", i%50))
+		}
+		for i := 0; i < 60; i++ {
+			r.LookupHost(context.Background(), fmt.Sprintf("cold%d-%d", round, i))
+		}
+		r.Tune()
+	}
+	if r.size() != 100 {
+		t.Errorf("got size %d, want 100", r.size())
+	}
+}
+
+func TestResolver_TuneConcurrentResize(t *testing.T) {
+	r, err := New(WithCacheSize(100), WithShards(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Resolver = &fakeResolver{}
+	r.MaxCacheSize = 800
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			r.Resize(50 + i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			for j := 0; j < 10; j++ {
+				r.LookupHost(context.Background(), fmt.Sprintf("host%d", i*10+j))
+			}
+			r.Tune()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			r.SetTTL(fmt.Sprintf("host%d", i), time.Minute)
+		}
+	}()
+	wg.Wait()
+	if size := r.size(); size < 50 || size > 800 {
+		t.Errorf("got size %d, want between 50 and 800", size)
+	}
+}
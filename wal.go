@@ -0,0 +1,61 @@
+package dnscache
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// appendWAL writes the successful entry e stored for key to the WAL, if any.
+// Write errors are ignored so a failing log never fails lookups.
+func (r *Resolver) appendWAL(key cacheKey, e *cacheEntry) {
+	if r.WAL == nil || e == nil || e.err != nil {
+		return
+	}
+	se, err := newSavedEntry(key, e)
+	if err != nil {
+		return
+	}
+	storedAt := e.storedAt
+	se.StoredAt = &storedAt
+	b, err := json.Marshal(se)
+	if err != nil {
+		return
+	}
+	r.walMu.Lock()
+	defer r.walMu.Unlock()
+	r.WAL.Write(append(b, '\n'))
+}
+
+// ReplayWAL reads the entries written to WAL from rd and adds them to the
+// cache, later entries replacing earlier ones for the same key. Expired
+// entries are skipped, dropping the earlier entries for their key. A
+// truncated last entry, as left by a crash, is ignored. An entry of an
+// unknown kind fails the replay, leaving the entries before it restored.
+func (r *Resolver) ReplayWAL(rd io.Reader) error {
+	defer r.reportSize()
+	now := r.getNow()
+	dec := json.NewDecoder(rd)
+	for {
+		var se savedEntry
+		err := dec.Decode(&se)
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		kind, err := savedKind(se.Kind)
+		if err != nil {
+			return err
+		}
+		if se.Expire != nil && !now.Before(*se.Expire) {
+			// The expired entry still supersedes earlier ones.
+			r.remove(cacheKey{kind: kind, subject: se.Subject})
+			continue
+		}
+		if err := r.restore(se, now); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package dnscache
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolver_ReplayWAL(t *testing.T) {
+	clock := newFakeClock()
+	var wal bytes.Buffer
+	f := &fakeResolver{hosts: map[string][]string{
+		"a.example.com": {"192.0.2.1"},
+		"b.example.com": {"192.0.2.2"},
+	}}
+	r := NewDNSResolver(10)
+	r.Resolver = f
+	r.TTL = time.Minute
+	r.WAL = &wal
+	r.clock = clock
+
+	ctx := context.Background()
+	r.LookupHost(ctx, "a.example.com")
+	r.LookupHost(ctx, "b.example.com")
+	r.Set("short.example.com", []string{"192.0.2.3"})
+	r.SetTTL("short.example.com", time.Second)
+	r.Set("short.example.com", []string{"192.0.2.4"})
+	f.setErr(errLookup)
+	r.LookupHost(ctx, "missing.example.com")
+	if got := strings.Count(wal.String(), "\n"); got != 4 {
+		t.Errorf("got %d WAL entries, want 4 for the successful results", got)
+	}
+
+	// Simulate a crash in the middle of an entry.
+	wal.WriteString(`{"kind":"h","subject":"tr`)
+	clock.Advance(2 * time.Second)
+	f2 := &fakeResolver{}
+	r2 := NewDNSResolver(10)
+	r2.Resolver = f2
+	r2.clock = clock
+	if err := r2.ReplayWAL(&wal); err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string][]string{
+		"a.example.com": {"192.0.2.1"},
+		"b.example.com": {"192.0.2.2"},
+	} {
+		addrs, hit, err := r2.LookupHostCached(ctx, host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hit || !reflect.DeepEqual(addrs, want) {
+			t.Errorf("LookupHostCached(%q) = %v, %v, want %v from the cache", host, addrs, hit, want)
+		}
+	}
+	if f2.callCount() != 0 {
+		t.Errorf("got %d upstream calls, want 0", f2.callCount())
+	}
+	// The last entry for short.example.com expired.
+	if _, _, ok := r2.EntryInfo(Key{Kind: KindHost, Subject: "short.example.com"}); ok {
+		t.Error("expired WAL entry replayed")
+	}
+	_, storedAt, _ := r2.EntryInfo(Key{Kind: KindHost, Subject: "a.example.com"})
+	if want := clock.Now().Add(-2 * time.Second); !storedAt.Equal(want) {
+		t.Errorf("got stored at %v, want %v", storedAt, want)
+	}
+}
+
+func TestResolver_ReplayWALInvalidKind(t *testing.T) {
+	clock := newFakeClock()
+	expired := clock.Now().Add(-time.Second).Format(time.RFC3339Nano)
+	for _, record := range []string{
+		`{"kind":"z","subject":"x","negative":true}`,
+		`{"kind":"z","subject":"x","expire":"` + expired + `"}`,
+		`{"kind":"","subject":"x","value":["192.0.2.1"]}`,
+	} {
+		r := NewDNSResolver(10)
+		r.Resolver = &fakeResolver{}
+		r.clock = clock
+		wal := `{"kind":"h","subject":"a.example.com","value":["192.0.2.1"]}` + "\n" + record + "\n"
+		if err := r.ReplayWAL(strings.NewReader(wal)); err == nil {
+			t.Errorf("got nil error replaying %s", record)
+		}
+		if got := r.Keys(); !reflect.DeepEqual(got, []Key{{KindHost, "a.example.com"}}) {
+			t.Errorf("got keys %v after replaying %s, want the valid entry only", got, record)
+		}
+		// Refreshing must not look up entries of unknown kinds.
+		r.Refresh()
+	}
+}
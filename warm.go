@@ -0,0 +1,80 @@
+package dnscache
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// batchConcurrency is the maximum number of lookups run in parallel by Warm
+// and LookupHosts.
+const batchConcurrency = 16
+
+// MultiError is a list of errors returned by operations performing several
+// lookups.
+type MultiError []error
+
+func (m MultiError) Error() string {
+	msgs := make([]string, len(m))
+	for i, err := range m {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Warm resolves hosts into the cache, running up to 16 lookups in parallel.
+// All hosts are looked up even if some fail; the failures are returned as a
+// MultiError.
+func (r *Resolver) Warm(ctx context.Context, hosts []string) error {
+	var errs MultiError
+	r.lookupHosts(ctx, hosts, func(host string, addrs []string, err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	})
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// LookupHosts looks up hosts, running up to 16 lookups in parallel. It
+// returns the addresses of the hosts successfully resolved and the errors of
+// the others.
+func (r *Resolver) LookupHosts(ctx context.Context, hosts []string) (addrs map[string][]string, errs map[string]error) {
+	addrs = map[string][]string{}
+	errs = map[string]error{}
+	r.lookupHosts(ctx, hosts, func(host string, hostAddrs []string, err error) {
+		if err != nil {
+			errs[host] = err
+			return
+		}
+		addrs[host] = hostAddrs
+	})
+	return addrs, errs
+}
+
+// lookupHosts looks up hosts with bounded concurrency, passing each result to
+// fn. Calls to fn are serialized.
+func (r *Resolver) lookupHosts(ctx context.Context, hosts []string, fn func(host string, addrs []string, err error)) {
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	sem := make(chan struct{}, batchConcurrency)
+	for _, host := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(host string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			addrs, err := r.LookupHost(ctx, host)
+			mu.Lock()
+			fn(host, addrs, err)
+			mu.Unlock()
+		}(host)
+	}
+	wg.Wait()
+}
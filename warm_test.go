@@ -0,0 +1,79 @@
+package dnscache
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// failingResolver wraps a DNSResolver, failing host lookups listed in fail.
+type failingResolver struct {
+	DNSResolver
+	fail map[string]error
+}
+
+func (f *failingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if err := f.fail[host]; err != nil {
+		return nil, err
+	}
+	return f.DNSResolver.LookupHost(ctx, host)
+}
+
+func TestResolver_Warm(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{
+		"a.com": {"1.1.1.1"},
+		"b.com": {"2.2.2.2"},
+		"c.com": {"3.3.3.3"},
+	}}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	hosts := []string{"a.com", "b.com", "c.com"}
+	if err := r.Warm(context.Background(), hosts); err != nil {
+		t.Fatal(err)
+	}
+	var misses int
+	r.OnCacheMiss = func() { misses++ }
+	for _, host := range hosts {
+		if _, err := r.LookupHost(context.Background(), host); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if misses != 0 {
+		t.Errorf("got %d misses after Warm, want 0", misses)
+	}
+}
+
+func TestResolver_WarmErrors(t *testing.T) {
+	f := &fakeResolver{err: errLookup}
+	r := NewDNSResolver(128)
+	r.Resolver = f
+	err := r.Warm(context.Background(), []string{"a.com", "b.com"})
+	errs, ok := err.(MultiError)
+	if !ok {
+		t.Fatalf("got %T, want MultiError", err)
+	}
+	if len(errs) != 2 {
+		t.Errorf("got %d errors, want 2", len(errs))
+	}
+	if r.Len() != 2 {
+		t.Errorf("got %d entries, want 2", r.Len())
+	}
+}
+
+func TestResolver_LookupHosts(t *testing.T) {
+	f := &fakeResolver{hosts: map[string][]string{
+		"a.com": {"1.1.1.1"},
+		"b.com": {"2.2.2.2", "3.3.3.3"},
+	}}
+	r := NewDNSResolver(128)
+	r.Resolver = &failingResolver{DNSResolver: f, fail: map[string]error{"fail.com": errLookup}}
+
+	addrs, errs := r.LookupHosts(context.Background(), []string{"a.com", "b.com", "fail.com", "a.com"})
+	want := map[string][]string{"a.com": {"1.1.1.1"}, "b.com": {"2.2.2.2", "3.3.3.3"}}
+	if !reflect.DeepEqual(addrs, want) {
+		t.Errorf("got addrs %v, want %v", addrs, want)
+	}
+	if len(errs) != 1 || errs["fail.com"] != errLookup {
+		t.Errorf("got errs %v, want fail.com to fail", errs)
+	}
+}